@@ -0,0 +1,167 @@
+package openbestpay
+
+/**
+商户账户模块
+查询商户/子商户的可用余额和待结算金额
+*/
+
+/**
+商户账户余额查询
+https://webpaywg.bestpay.com.cn/account/queryBalance
+*/
+type bestpay_account_balance struct {
+	BestpayApi
+}
+
+func (a *bestpay_account_balance) apiMethod() string {
+	return BESTPAY_URL_ACCOUNT_BALANCE
+}
+
+func (a *bestpay_account_balance) apiName() string {
+	return "商户余额查询"
+}
+
+type Biz_bestpay_account_balance struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`           //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                 //子商户.为空时查询 merchantId 本身 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`          //商户执行时需填入相应密码 ，又称:交易key
+	ReqNo         string `json:"reqNo,omitempty" bestpay:"required,max=30,even"`           //查询请求流水号.商户平台唯一 30
+	ReqDate       string `json:"reqDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	Mac           string `json:"mac,omitempty"`                                            //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_account_balance) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&SUBMERCHANTID=" + b.SubMerchantId
+	tobe_mac += "&MERCHANTPWD=" + b.MerchantPwd
+	tobe_mac += "&REQNO=" + b.ReqNo
+	tobe_mac += "&REQDATE=" + b.ReqDate
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_account_balance) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+type Resp_bestpay_account_balance struct {
+	MerchantId    string `json:"merchantId,omitempty"`          //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty"`       //子商户 30
+	AvailableAmt  int    `json:"availableAmt,omitempty,string"` //单位:分。可用余额
+	FrozenAmt     int    `json:"frozenAmt,omitempty,string"`    //单位:分。冻结金额
+	UnsettledAmt  int    `json:"unsettledAmt,omitempty,string"` //单位:分。待结算金额
+	TotalAmt      int    `json:"totalAmt,omitempty,string"`     //单位:分。账户总额 = 可用 + 冻结 + 待结算
+	QueryTime     string `json:"queryTime,omitempty"`           //余额对应的时间 yyyyMMddhhmmss
+	Sign          string `json:"sign,omitempty"`                //十六进制
+}
+
+/**
+商户结算查询
+https://webpaywg.bestpay.com.cn/account/querySettlement
+按结算日期查询结算记录
+*/
+type bestpay_account_settlement struct {
+	BestpayApi
+}
+
+func (a *bestpay_account_settlement) apiMethod() string {
+	return BESTPAY_URL_ACCOUNT_SETTLEMENT
+}
+
+func (a *bestpay_account_settlement) apiName() string {
+	return "商户结算查询"
+}
+
+type Biz_bestpay_account_settlement struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`           //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                 //子商户.为空时查询 merchantId 本身 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`          //商户执行时需填入相应密码 ，又称:交易key
+	ReqNo         string `json:"reqNo,omitempty" bestpay:"required,max=30,even"`           //查询请求流水号.商户平台唯一 30
+	ReqDate       string `json:"reqDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	SettleDate    string `json:"settleDate,omitempty" bestpay:"required,date=yyyyMMdd"`    //结算日期 yyyyMMdd
+	Mac           string `json:"mac,omitempty"`                                            //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_account_settlement) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&SUBMERCHANTID=" + b.SubMerchantId
+	tobe_mac += "&MERCHANTPWD=" + b.MerchantPwd
+	tobe_mac += "&REQNO=" + b.ReqNo
+	tobe_mac += "&REQDATE=" + b.ReqDate
+	tobe_mac += "&SETTLEDATE=" + b.SettleDate
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_account_settlement) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+//结算状态 settleStatus
+const (
+	SETTLE_STATUS_PENDING = "A" //待结算
+	SETTLE_STATUS_DONE    = "B" //已结算
+	SETTLE_STATUS_FAIL    = "C" //结算失败
+)
+
+//一条结算记录
+type SettlementItem struct {
+	SettleNo     string `json:"settleNo,omitempty"`         //结算流水号
+	SettleDate   string `json:"settleDate,omitempty"`       //结算日期 yyyyMMdd
+	TradeAmt     int    `json:"tradeAmt,omitempty,string"`  //单位:分。交易金额
+	RefundAmt    int    `json:"refundAmt,omitempty,string"` //单位:分。退款金额
+	FeeAmt       int    `json:"feeAmt,omitempty,string"`    //单位:分。手续费
+	SettleAmt    int    `json:"settleAmt,omitempty,string"` //单位:分。结算金额 = 交易 - 退款 - 手续费
+	SettleStatus string `json:"settleStatus,omitempty"`     //A:待结算 B:已结算 C:结算失败
+	BankAccount  string `json:"bankAccount,omitempty"`      //结算银行账号(脱敏)
+}
+
+type Resp_bestpay_account_settlement struct {
+	MerchantId    string           `json:"merchantId,omitempty"`        //由翼支付网关平台统一分配 30
+	SubMerchantId string           `json:"subMerchantId,omitempty"`     //子商户 30
+	PendingAmt    int              `json:"pendingAmt,omitempty,string"` //单位:分。待结算合计
+	SettledAmt    int              `json:"settledAmt,omitempty,string"` //单位:分。已结算合计
+	Items         []SettlementItem `json:"items,omitempty"`             //结算记录
+	Sign          string           `json:"sign,omitempty"`              //十六进制
+}
+
+//一个商户的余额查询结果
+type MerchantBalance struct {
+	Balance Resp_bestpay_account_balance
+	Err     error
+}
+
+/**
+依次查询多个商户的余额.返回的 map 以 merchantId 或者 merchantId/subMerchantId 为 key
+某个商户查询失败不影响其它商户.错误放在对应的 Err 中
+*/
+func QueryBalances(key string, bizs []Biz_bestpay_account_balance) map[string]MerchantBalance {
+	ret := map[string]MerchantBalance{}
+	for _, biz := range bizs {
+		id := biz.MerchantId
+		if biz.SubMerchantId != "" {
+			id += "/" + biz.SubMerchantId
+		}
+
+		mb := MerchantBalance{}
+		api := GetApi(BESTPAY_URL_ACCOUNT_BALANCE)
+		if mb.Err = api.SetBizContent(biz, key); mb.Err == nil {
+			if mb.Err = api.Run(); mb.Err == nil {
+				_, mb.Err = api.Response(&mb.Balance)
+			}
+		}
+		ret[id] = mb
+	}
+	return ret
+}
+
+func init() {
+	registerApi(new(bestpay_account_balance))
+	registerApi(new(bestpay_account_settlement))
+}
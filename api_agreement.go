@@ -0,0 +1,268 @@
+package openbestpay
+
+import (
+	"fmt"
+)
+
+/**
+委托代扣
+1.签约:商户发起签约.用户在翼支付确认之后生成协议号 agreementNo.签约结果通过 backUrl 异步通知
+2.扣款:每个周期商户用 agreementNo 直接扣款.不需要用户付款码
+3.查询:按 agreementNo 或者 agreementReqNo 查询协议状态
+4.解约:用户取消订阅时解约.解约之后不能再扣款
+*/
+
+//协议状态 agreementStatus
+const (
+	AGREEMENT_STATUS_SIGNING   = "A" //签约中
+	AGREEMENT_STATUS_SIGNED    = "B" //已签约
+	AGREEMENT_STATUS_CANCELLED = "C" //已解约
+)
+
+/**
+委托代扣 签约
+https://webpaywg.bestpay.com.cn/agreement/sign
+*/
+type bestpay_agreement_sign struct {
+	BestpayApi
+}
+
+func (a *bestpay_agreement_sign) apiMethod() string {
+	return BESTPAY_URL_AGREEMENT_SIGN
+}
+
+func (a *bestpay_agreement_sign) apiName() string {
+	return "委托代扣签约"
+}
+
+type Biz_bestpay_agreement_sign struct {
+	MerchantId       string `json:"merchantId,omitempty" bestpay:"required,max=30"`                    //由翼支付网关平台统一分配 30
+	SubMerchantId    string `json:"subMerchantId,omitempty" bestpay:"max=30"`                          //由商户平台自己分配 30
+	AgreementReqNo   string `json:"agreementReqNo,omitempty" bestpay:"required,max=30,even"`           //签约请求流水号.商户平台唯一 30
+	AgreementReqDate string `json:"agreementReqDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	CustomerId       string `json:"customerId,omitempty" bestpay:"required,max=32"`                    //用户在商户平台的标识 32
+	UserPhone        string `json:"userPhone,omitempty" bestpay:"max=11"`                              //用户的翼支付账号(手机号) 11
+	ProductName      string `json:"productName,omitempty" bestpay:"required,max=128"`                  //代扣的产品名称.展示给用户 128
+	MaxAmt           int    `json:"maxAmt,omitempty,string" bestpay:"min=1"`                           //单位:分。单次扣款的最大金额
+	PageUrl          string `json:"pageUrl,omitempty" bestpay:"max=255"`                               //用户签约完成之后跳转的地址 255
+	BackUrl          string `json:"backUrl,omitempty" bestpay:"max=255"`                               //签约结果异步通知地址 255
+	Attach           string `json:"attach,omitempty" bestpay:"max=128"`                                //商户附加信息 128
+	Mac              string `json:"mac,omitempty"`                                                     //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_agreement_sign) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&AGREEMENTREQNO=" + b.AgreementReqNo
+	tobe_mac += "&AGREEMENTREQDATE=" + b.AgreementReqDate
+	tobe_mac += "&CUSTOMERID=" + b.CustomerId
+	tobe_mac += fmt.Sprintf("&%s=%d", "MAXAMT", b.MaxAmt)
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_agreement_sign) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+type Resp_bestpay_agreement_sign struct {
+	MerchantId      string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	AgreementReqNo  string `json:"agreementReqNo,omitempty"`  //签约请求流水号 30
+	AgreementNo     string `json:"agreementNo,omitempty"`     //协议号.签约成功之后才有 32
+	AgreementStatus string `json:"agreementStatus,omitempty"` //A:签约中 B:已签约 C:已解约
+	SignUrl         string `json:"signUrl,omitempty"`         //用户确认签约的页面地址.需要跳转用户浏览器
+	Sign            string `json:"sign,omitempty"`            //十六进制
+}
+
+/**
+委托代扣 签约查询
+https://webpaywg.bestpay.com.cn/agreement/query
+*/
+type bestpay_agreement_query struct {
+	BestpayApi
+}
+
+func (a *bestpay_agreement_query) apiMethod() string {
+	return BESTPAY_URL_AGREEMENT_QUERY
+}
+
+func (a *bestpay_agreement_query) apiName() string {
+	return "委托代扣签约查询"
+}
+
+type Biz_bestpay_agreement_query struct {
+	MerchantId     string `json:"merchantId,omitempty" bestpay:"required,max=30"` //由翼支付网关平台统一分配 30
+	AgreementNo    string `json:"agreementNo,omitempty" bestpay:"max=32"`         //协议号 与 agreementReqNo 二选一 32
+	AgreementReqNo string `json:"agreementReqNo,omitempty" bestpay:"max=30,even"` //签约请求流水号 与 agreementNo 二选一 30
+	Mac            string `json:"mac,omitempty"`                                  //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_agreement_query) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&AGREEMENTNO=" + b.AgreementNo
+	tobe_mac += "&AGREEMENTREQNO=" + b.AgreementReqNo
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_agreement_query) valid() error {
+	ve := validStruct(b)
+
+	if b.AgreementNo == "" && b.AgreementReqNo == "" {
+		ve.add("agreementNo", RULE_REQUIRED, MSG_ONE_OF_REQUIRED, "agreementReqNo")
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+type Resp_bestpay_agreement_query struct {
+	MerchantId      string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	AgreementNo     string `json:"agreementNo,omitempty"`     //协议号 32
+	AgreementReqNo  string `json:"agreementReqNo,omitempty"`  //签约请求流水号 30
+	AgreementStatus string `json:"agreementStatus,omitempty"` //A:签约中 B:已签约 C:已解约
+	CustomerId      string `json:"customerId,omitempty"`      //用户在商户平台的标识
+	MaxAmt          int    `json:"maxAmt,omitempty,string"`   //单位:分。单次扣款的最大金额
+	SignDate        string `json:"signDate,omitempty"`        //签约时间 yyyyMMddhhmmss
+	CancelDate      string `json:"cancelDate,omitempty"`      //解约时间 yyyyMMddhhmmss
+	Sign            string `json:"sign,omitempty"`            //十六进制
+}
+
+/**
+委托代扣 解约
+https://webpaywg.bestpay.com.cn/agreement/cancel
+*/
+type bestpay_agreement_cancel struct {
+	BestpayApi
+}
+
+func (a *bestpay_agreement_cancel) apiMethod() string {
+	return BESTPAY_URL_AGREEMENT_CANCEL
+}
+
+func (a *bestpay_agreement_cancel) apiName() string {
+	return "委托代扣解约"
+}
+
+type Biz_bestpay_agreement_cancel struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`                 //由翼支付网关平台统一分配 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`                //商户执行时需填入相应密码 ，又称:交易key
+	AgreementNo   string `json:"agreementNo,omitempty" bestpay:"required,max=32"`                //协议号 32
+	CancelReqNo   string `json:"cancelReqNo,omitempty" bestpay:"required,max=30,even"`           //解约请求流水号.商户平台唯一 30
+	CancelReqDate string `json:"cancelReqDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	Mac           string `json:"mac,omitempty"`                                                  //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_agreement_cancel) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&MERCHANTPWD=" + b.MerchantPwd
+	tobe_mac += "&AGREEMENTNO=" + b.AgreementNo
+	tobe_mac += "&CANCELREQNO=" + b.CancelReqNo
+	tobe_mac += "&CANCELREQDATE=" + b.CancelReqDate
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_agreement_cancel) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+type Resp_bestpay_agreement_cancel struct {
+	MerchantId      string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	AgreementNo     string `json:"agreementNo,omitempty"`     //协议号 32
+	CancelReqNo     string `json:"cancelReqNo,omitempty"`     //解约请求流水号 30
+	AgreementStatus string `json:"agreementStatus,omitempty"` //A:签约中 B:已签约 C:已解约
+	Sign            string `json:"sign,omitempty"`            //十六进制
+}
+
+/**
+委托代扣 扣款
+https://webpaywg.bestpay.com.cn/agreement/deduct
+*/
+type bestpay_agreement_deduct struct {
+	BestpayApi
+}
+
+func (a *bestpay_agreement_deduct) apiMethod() string {
+	return BESTPAY_URL_AGREEMENT_DEDUCT
+}
+
+func (a *bestpay_agreement_deduct) apiName() string {
+	return "委托代扣扣款"
+}
+
+type Biz_bestpay_agreement_deduct struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`            //商户执行时需填入相应密码 ，又称:交易key
+	AgreementNo   string `json:"agreementNo,omitempty" bestpay:"required,max=32"`            //协议号 32
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，全局唯一 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额.不能超过签约时的 maxAmt
+	ProductAmt    int    `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int    `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	LedgerDetail  string `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //分账明细 256
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_agreement_deduct) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&MERCHANTPWD=" + b.MerchantPwd
+	tobe_mac += "&AGREEMENTNO=" + b.AgreementNo
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_agreement_deduct) valid() error {
+	ve := validStruct(b)
+
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+type Resp_bestpay_agreement_deduct struct {
+	MerchantId   string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	AgreementNo  string `json:"agreementNo,omitempty"`     //协议号 32
+	OrderNo      string `json:"orderNo,omitempty"`         //商户订单号 30
+	OrderReqNo   string `json:"orderReqNo,omitempty"`      //商户请求流水号 30
+	OurTransNo   string `json:"ourTransNo,omitempty"`      //翼支付生成的内部流水号 30
+	TransAmt     int    `json:"transAmt,omitempty,string"` //单位:分。
+	TransStatus  string `json:"transStatus,omitempty"`     //A:请求(支付中) B:成功(支付成功) C:失败(订单状态结果)
+	PayChannel   string `json:"payChannel,omitempty"`      //付款明细 30
+	Coupon       int    `json:"coupon,omitempty,string"`   //单位:分。 订单优惠金额
+	PayerAccount string `json:"payerAccount,omitempty"`    //付款人账 号 30
+	Sign         string `json:"sign,omitempty"`            //十六进制
+}
+
+//付款明细
+func (r Resp_bestpay_agreement_deduct) PayChannelDetail() (PayChannelDetail, error) {
+	return ParsePayChannel(r.PayChannel, r.TransAmt)
+}
+
+func init() {
+	registerApi(new(bestpay_agreement_sign))
+	registerApi(new(bestpay_agreement_query))
+	registerApi(new(bestpay_agreement_cancel))
+	registerApi(new(bestpay_agreement_deduct))
+}
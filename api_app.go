@@ -0,0 +1,176 @@
+package openbestpay
+
+import (
+	"fmt"
+	"net/url"
+	"reflect"
+	"strings"
+)
+
+/**
+App 支付
+1.服务端调用 App 下单接口创建订单
+2.服务端用 AppOrderInfo 生成带签名的订单信息.返回给客户端
+3.客户端把订单信息传给翼支付 app sdk 拉起支付
+4.支付结果以 backUrl 的异步通知或者交易查询为准
+*/
+
+/**
+App 下单
+https://webpaywg.bestpay.com.cn/app/placeOrder
+*/
+type bestpay_app_order struct {
+	BestpayApi
+}
+
+func (a *bestpay_app_order) apiMethod() string {
+	return BESTPAY_URL_APP_ORDER
+}
+
+func (a *bestpay_app_order) apiName() string {
+	return "App下单"
+}
+
+type Biz_bestpay_app_order struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，全局唯一 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额
+	ProductAmt    int    `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int    `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	BusiType      string `json:"busiType,omitempty"`                                         //默认填:0000001
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	LedgerDetail  string `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //分账明细 256
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_app_order) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+//busiType 没有填的时候使用默认值
+func (b Biz_bestpay_app_order) defaults() bizInterface {
+	if b.BusiType == "" {
+		b.BusiType = "0000001"
+	}
+	return b
+}
+
+func (b Biz_bestpay_app_order) valid() error {
+	ve := validStruct(b)
+
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+type Resp_bestpay_app_order struct {
+	MerchantId string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	OrderNo    string `json:"orderNo,omitempty"`         //商户订单号 30
+	OrderReqNo string `json:"orderReqNo,omitempty"`      //商户请求流水号 30
+	TransAmt   int    `json:"transAmt,omitempty,string"` //单位:分。
+	Sign       string `json:"sign,omitempty"`            //十六进制
+}
+
+/**
+App sdk 需要的订单信息
+与 App 下单时的订单号/流水号/金额保持一致
+*/
+type Biz_bestpay_app_orderinfo struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //与 App 下单时相同 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //与 App 下单时相同 30
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //与 App 下单时相同
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。与 App 下单时相同
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	CustomerId    string `json:"customerId,omitempty" bestpay:"max=32"`                      //用户在商户平台的标识 32
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_app_orderinfo) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_app_orderinfo) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+/**
+生成 app sdk 需要的订单信息.key 与 SetBizContent 的 key 相同
+格式为 key=value&key=value.按结构体字段的顺序.值为空以及金额为 0 的不传.最后是 mac
+value 做 url 编码.避免 attach 之类的字段中带有 & = 时拆错
+*/
+func AppOrderInfo(biz Biz_bestpay_app_orderinfo, key string) (string, error) {
+	api := BestpayApi{}
+	if err := api.SetBizContent(biz, key); err != nil {
+		return "", err
+	}
+
+	return api.order_info(), nil
+}
+
+//按结构体字段的顺序拼接签名之后的参数
+func (b *BestpayApi) order_info() string {
+	sign := b.mac()
+
+	t := reflect.TypeOf(b.params)
+	v := reflect.ValueOf(b.params)
+
+	parts := []string{}
+	for i := 0; i < t.NumField(); i++ {
+		key := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+		if key == "" || key == "-" {
+			continue
+		}
+
+		fv := v.Field(i)
+		switch fv.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if fv.Int() == 0 {
+				continue
+			}
+		}
+
+		value := fmt.Sprintf("%v", fv.Interface())
+		if key == "mac" {
+			value = sign
+		}
+		if value == "" {
+			continue
+		}
+		parts = append(parts, key+"="+url.QueryEscape(value))
+	}
+
+	return strings.Join(parts, "&")
+}
+
+func init() {
+	registerApi(new(bestpay_app_order))
+}
@@ -0,0 +1,330 @@
+package openbestpay
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liteck/logs"
+)
+
+/**
+审计
+每次 Run 之后把发送的参数(脱敏) mac 网关返回(脱敏) 验签结果和耗时交给 AuditSink
+	sink, err := NewFileAuditSink("/var/log/bestpay/audit.log")
+	sink.MaxSize = 100 << 20
+	SetAuditSink(sink)
+AuditSink 返回的错误只记日志.不影响接口的结果.因为这时候请求可能已经发送到网关了
+拦截器直接返回(没有调用 next) 或者被熔断 限流的.Sent 为 false
+*/
+
+//验签结果
+const (
+	SIGN_ABSENT    = "absent"    //网关没有返回 sign
+	SIGN_UNCHECKED = "unchecked" //没有设置 SignVerifier
+	SIGN_VALID     = "valid"
+	SIGN_INVALID   = "invalid"
+)
+
+//一次调用的审计记录
+type AuditRecord struct {
+	Time       time.Time         `json:"time"`                 //开始时间
+	ApiName    string            `json:"apiName"`              //接口名称
+	Method     string            `json:"method"`               //接口地址
+	MerchantId string            `json:"merchantId,omitempty"` //商户号
+	OrderNo    string            `json:"orderNo,omitempty"`    //订单号
+	Params     map[string]string `json:"params"`               //发送的参数.已脱敏.不包括 mac
+	Mac        string            `json:"mac"`                  //计算出来的 mac
+	Raw        string            `json:"raw,omitempty"`        //网关返回的原始数据.已脱敏
+	Sent       bool              `json:"sent"`                 //请求是否发送到网关
+	Sign       string            `json:"sign"`                 //验签结果 SIGN_*
+	SignError  string            `json:"signError,omitempty"`  //验签失败的原因
+	Error      string            `json:"error,omitempty"`      //网络错误 熔断 限流等
+	ElapsedMs  int64             `json:"elapsedMs"`            //耗时 毫秒
+}
+
+type AuditSink interface {
+	Audit(r AuditRecord) error
+}
+
+//验证网关返回的签名.raw 为原始数据 key 为商户秘钥.验签失败返回错误
+type SignVerifier func(method, raw, key string) error
+
+var (
+	auditSink         AuditSink
+	signVerifier      SignVerifier
+	auditRedactFields = map[string]bool{
+		"merchantPwd":  true,
+		"barcode":      true,
+		"payerAccount": true,
+		"customerId":   true,
+		"transPhone":   true,
+		"userPhone":    true,
+	}
+	auditMutex sync.RWMutex
+)
+
+//设置审计.nil 关闭
+func SetAuditSink(s AuditSink) {
+	auditMutex.Lock()
+	auditSink = s
+	auditMutex.Unlock()
+}
+
+//设置验签方法.nil 时审计记录的验签结果为 SIGN_UNCHECKED
+func SetSignVerifier(v SignVerifier) {
+	auditMutex.Lock()
+	signVerifier = v
+	auditMutex.Unlock()
+}
+
+//设置需要脱敏的字段.发送的参数和网关返回的数据都按这些字段脱敏
+//默认 merchantPwd barcode payerAccount customerId transPhone userPhone
+func SetAuditRedactFields(fields ...string) {
+	m := map[string]bool{}
+	for _, f := range fields {
+		m[f] = true
+	}
+
+	auditMutex.Lock()
+	auditRedactFields = m
+	auditMutex.Unlock()
+}
+
+//脱敏之后的值.长度也不保留
+const AUDIT_REDACTED = "******"
+
+//网关返回的数据脱敏.不是 json 或者没有需要脱敏的字段时原样返回
+func redactRaw(raw string, fields map[string]bool) string {
+	var v interface{}
+	d := json.NewDecoder(strings.NewReader(raw))
+	d.UseNumber()
+	if err := d.Decode(&v); err != nil || !redactValue(v, fields) {
+		return raw
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return raw
+	}
+	return string(b)
+}
+
+//按字段名脱敏.包括嵌套的对象和数组.返回是否有修改
+func redactValue(v interface{}, fields map[string]bool) bool {
+	changed := false
+	switch x := v.(type) {
+	case map[string]interface{}:
+		for k, e := range x {
+			if fields[k] {
+				if e != nil && e != "" {
+					x[k] = AUDIT_REDACTED
+					changed = true
+				}
+			} else if redactValue(e, fields) {
+				changed = true
+			}
+		}
+	case []interface{}:
+		for _, e := range x {
+			if redactValue(e, fields) {
+				changed = true
+			}
+		}
+	}
+	return changed
+}
+
+//验签
+func verifySign(method, raw, key string, verifier SignVerifier) (string, string) {
+	var tmp struct {
+		Result struct {
+			Sign string `json:"sign"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(raw), &tmp); err != nil || tmp.Result.Sign == "" {
+		return SIGN_ABSENT, ""
+	}
+	if verifier == nil {
+		return SIGN_UNCHECKED, ""
+	}
+	if err := verifier(method, raw, key); err != nil {
+		return SIGN_INVALID, err.Error()
+	}
+	return SIGN_VALID, ""
+}
+
+//生成审计记录并交给 AuditSink
+func (b *BestpayApi) audit(inv *Invocation, start time.Time, err error) {
+	auditMutex.RLock()
+	sink, verifier, fields := auditSink, signVerifier, auditRedactFields
+	auditMutex.RUnlock()
+
+	if sink == nil {
+		return
+	}
+
+	r := AuditRecord{
+		Time:       start,
+		ApiName:    inv.ApiName,
+		Method:     inv.Method,
+		MerchantId: bizField(inv.Biz, "MerchantId"),
+		OrderNo:    bizField(inv.Biz, "OrderNo"),
+		Params:     map[string]string{},
+		Raw:        redactRaw(inv.Raw, fields),
+		Sent:       inv.sent,
+		ElapsedMs:  int64(time.Since(start) / time.Millisecond),
+	}
+	if r.OrderNo == "" {
+		r.OrderNo = bizField(inv.Biz, "OldOrderNo")
+	}
+
+	for k, v := range inv.Params {
+		value := fmt.Sprintf("%v", v)
+		switch {
+		case k == "mac":
+			r.Mac = value
+		case fields[k]:
+			r.Params[k] = AUDIT_REDACTED
+		case value != "":
+			r.Params[k] = value
+		}
+	}
+
+	if err != nil {
+		r.Error = err.Error()
+		r.Sign = SIGN_ABSENT
+	} else {
+		r.Sign, r.SignError = verifySign(inv.Method, inv.Raw, b.Key, verifier)
+	}
+
+	if err := sink.Audit(r); err != nil {
+		logs.Error(fmt.Sprintf("==[audit]==[%s]==[%s]", inv.ApiName, err.Error()))
+	}
+}
+
+/**
+文件形式的审计.每行一个 json
+文件超过 MaxSize 或者跨天时轮转.旧文件重命名为 path.yyyyMMddhhmmss
+超过 MaxBackups 的旧文件会被删除
+*/
+type FileAuditSink struct {
+	MaxSize    int64 //单个文件的最大字节数.0 不按大小轮转
+	MaxBackups int   //保留的旧文件数.0 全部保留
+
+	path  string
+	file  *os.File
+	size  int64
+	day   string //当前文件的日期 yyyyMMdd
+	mutex sync.Mutex
+}
+
+//测试时替换
+var auditNow = time.Now
+
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f := &FileAuditSink{path: path}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *FileAuditSink) open() error {
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+
+	f.file = file
+	f.size = info.Size()
+	f.day = info.ModTime().Format("20060102")
+	if f.size == 0 {
+		f.day = auditNow().Format("20060102")
+	}
+	return nil
+}
+
+func (f *FileAuditSink) rotate(now time.Time) error {
+	if err := f.file.Close(); err != nil {
+		return err
+	}
+	f.file = nil
+
+	name := f.path + "." + now.Format("20060102150405")
+	for i := 1; ; i++ {
+		if _, err := os.Stat(name); os.IsNotExist(err) {
+			break
+		}
+		name = fmt.Sprintf("%s.%s.%d", f.path, now.Format("20060102150405"), i)
+	}
+	if err := os.Rename(f.path, name); err != nil {
+		return err
+	}
+
+	if f.MaxBackups > 0 {
+		backups, _ := filepath.Glob(f.path + ".*")
+		//文件名里面是时间.按名称排序就是按时间排序
+		sort.Strings(backups)
+		for len(backups) > f.MaxBackups {
+			os.Remove(backups[0])
+			backups = backups[1:]
+		}
+	}
+
+	return f.open()
+}
+
+func (f *FileAuditSink) Audit(r AuditRecord) error {
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		if err := f.open(); err != nil {
+			return err
+		}
+	}
+
+	now := auditNow()
+	if f.size > 0 && (now.Format("20060102") != f.day || (f.MaxSize > 0 && f.size+int64(len(b)) > f.MaxSize)) {
+		if err := f.rotate(now); err != nil {
+			return err
+		}
+	}
+
+	n, err := f.file.Write(b)
+	f.size += int64(n)
+	if err != nil {
+		return err
+	}
+	return f.file.Sync()
+}
+
+func (f *FileAuditSink) Close() error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if f.file == nil {
+		return nil
+	}
+	err := f.file.Close()
+	f.file = nil
+	return err
+}
@@ -0,0 +1,292 @@
+package openbestpay
+
+import (
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"sort"
+	"strings"
+	"sync"
+)
+
+/**
+BANKID 的字段说明
+输入接口响应过来的 bankid.. 返回对应的说明
+
+数据来自内置的 bankid 目录(见 api_bankid_data.go).查找顺序:
+	1.账户类的 bankid 完全匹配 如 EPAYACC VOUCHER_3AC
+	2.按后缀区分渠道 如 ICBC_B2C ICBC_Q.去掉后缀之后就是银行编码
+目录可以在运行时通过 LoadBankIdCatalog 整体替换.或者 SetBankIdAccount SetBank 补充
+*/
+
+//渠道类别
+const (
+	BANK_CHANNEL_BALANCE = "balance" //个账余额
+	BANK_CHANNEL_QUICK   = "quick"   //快捷支付
+	BANK_CHANNEL_B2B     = "b2b"     //企业网银
+	BANK_CHANNEL_B2C     = "b2c"     //个人网银
+	BANK_CHANNEL_NONE    = "none"    //无
+)
+
+//卡类型
+const (
+	CARD_TYPE_DEBIT  = "debit"  //借记卡
+	CARD_TYPE_CREDIT = "credit" //信用卡
+)
+
+type BankId struct {
+	Category string //类别
+	BankId   string //bankId 字段.
+	Desc     string //具体说明
+	Channel  string //渠道类别 BANK_CHANNEL_*
+	BankCode string //银行编码.账户类的为空
+	BankName string //银行名称.账户类的为空
+	CardType string //卡类型 CARD_TYPE_*.不确定的为空
+	FundType string //资金类型 FUND_TYPE_*
+}
+
+//bankid 目录
+type BankIdCatalog struct {
+	Version  string          `json:"version"`  //目录版本
+	Accounts []BankIdAccount `json:"accounts"` //账户类 bankid.完全匹配
+	Banks    []Bank          `json:"banks"`    //银行
+	Suffixes []BankIdSuffix  `json:"suffixes"` //bankid 后缀对应的渠道
+}
+
+//账户类 bankid.如 EPAYACC
+type BankIdAccount struct {
+	BankId   string            `json:"bankId"`
+	Channel  string            `json:"channel"`
+	CardType string            `json:"cardType,omitempty"`
+	FundType string            `json:"fundType,omitempty"` //资金类型 FUND_TYPE_*.为空时按渠道类别推断
+	Name     map[string]string `json:"name"`               //按语言区分的名称 {"zh":"翼支付账户","en":"Bestpay account"}
+}
+
+type Bank struct {
+	Code string            `json:"code"` //银行编码 如 ICBC
+	Name map[string]string `json:"name"` //按语言区分的名称
+}
+
+//bankid 后缀.如 _B2C _Q
+type BankIdSuffix struct {
+	Suffix   string `json:"suffix"`
+	Channel  string `json:"channel"`
+	CardType string `json:"cardType,omitempty"`
+}
+
+type bankIdIndex struct {
+	version  string
+	accounts map[string]BankIdAccount
+	banks    map[string]Bank
+	suffixes []BankIdSuffix //按后缀长度从长到短排序
+}
+
+var (
+	bankIdCatalog      *bankIdIndex
+	bankIdCatalogMutex sync.RWMutex
+)
+
+//渠道类别只能是 BANK_CHANNEL_*.否则取不到类别和说明
+func validBankChannel(c string) bool {
+	switch c {
+	case BANK_CHANNEL_BALANCE, BANK_CHANNEL_QUICK, BANK_CHANNEL_B2B, BANK_CHANNEL_B2C, BANK_CHANNEL_NONE:
+		return true
+	}
+	return false
+}
+
+func newBankIdIndex(c BankIdCatalog) (*bankIdIndex, error) {
+	if c.Version == "" {
+		return nil, msgError(MSG_FIELD_NIL, "bankid catalog version")
+	}
+
+	idx := &bankIdIndex{
+		version:  c.Version,
+		accounts: map[string]BankIdAccount{},
+		banks:    map[string]Bank{},
+	}
+
+	for _, a := range c.Accounts {
+		if a.BankId == "" {
+			return nil, msgError(MSG_FIELD_NIL, "bankid catalog accounts.bankId")
+		}
+		if !validBankChannel(a.Channel) {
+			return nil, msgError(MSG_FIELD_FORMAT, "bankid catalog accounts.channel", a.Channel)
+		}
+		idx.accounts[a.BankId] = a
+	}
+
+	for _, b := range c.Banks {
+		if b.Code == "" {
+			return nil, msgError(MSG_FIELD_NIL, "bankid catalog banks.code")
+		}
+		idx.banks[b.Code] = b
+	}
+
+	for _, s := range c.Suffixes {
+		if s.Suffix == "" {
+			return nil, msgError(MSG_FIELD_NIL, "bankid catalog suffixes.suffix")
+		}
+		if !validBankChannel(s.Channel) {
+			return nil, msgError(MSG_FIELD_FORMAT, "bankid catalog suffixes.channel", s.Channel)
+		}
+		idx.suffixes = append(idx.suffixes, s)
+	}
+	sort.SliceStable(idx.suffixes, func(i, j int) bool {
+		return len(idx.suffixes[i].Suffix) > len(idx.suffixes[j].Suffix)
+	})
+
+	return idx, nil
+}
+
+func parseBankIdCatalog(data []byte) (*bankIdIndex, error) {
+	var c BankIdCatalog
+	if err := json.Unmarshal(data, &c); err != nil {
+		return nil, err
+	}
+	return newBankIdIndex(c)
+}
+
+//整体替换 bankid 目录.格式与内置目录相同(json)
+func LoadBankIdCatalog(r io.Reader) error {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+
+	idx, err := parseBankIdCatalog(data)
+	if err != nil {
+		return err
+	}
+
+	bankIdCatalogMutex.Lock()
+	bankIdCatalog = idx
+	bankIdCatalogMutex.Unlock()
+	return nil
+}
+
+//恢复为内置的 bankid 目录
+func ResetBankIdCatalog() {
+	idx, err := parseBankIdCatalog([]byte(bankIdCatalogData))
+	if err != nil {
+		panic("openbestpay: invalid builtin bankid catalog: " + err.Error())
+	}
+
+	bankIdCatalogMutex.Lock()
+	bankIdCatalog = idx
+	bankIdCatalogMutex.Unlock()
+}
+
+//当前使用的 bankid 目录版本
+func BankIdCatalogVersion() string {
+	bankIdCatalogMutex.RLock()
+	defer bankIdCatalogMutex.RUnlock()
+	return bankIdCatalog.version
+}
+
+//补充或者覆盖一个账户类的 bankid
+func SetBankIdAccount(a BankIdAccount) error {
+	if a.BankId == "" {
+		return msgError(MSG_FIELD_NIL, "bankId")
+	}
+	if !validBankChannel(a.Channel) {
+		return msgError(MSG_FIELD_FORMAT, "channel", a.Channel)
+	}
+
+	bankIdCatalogMutex.Lock()
+	bankIdCatalog.accounts[a.BankId] = a
+	bankIdCatalogMutex.Unlock()
+	return nil
+}
+
+//补充或者覆盖一个银行
+func SetBank(b Bank) error {
+	if b.Code == "" {
+		return msgError(MSG_FIELD_NIL, "code")
+	}
+
+	bankIdCatalogMutex.Lock()
+	bankIdCatalog.banks[b.Code] = b
+	bankIdCatalogMutex.Unlock()
+	return nil
+}
+
+//按银行编码查找银行
+func GetBank(code string) (Bank, bool) {
+	bankIdCatalogMutex.RLock()
+	defer bankIdCatalogMutex.RUnlock()
+	b, ok := bankIdCatalog.banks[code]
+	return b, ok
+}
+
+//按语言取名称.没有的话取中文
+func localName(names map[string]string, l string) string {
+	if v, ok := names[l]; ok && v != "" {
+		return v
+	}
+	return names[LANG_ZH]
+}
+
+func GetBankId(bankid string) BankId {
+	return GetBankIdLang(bankid, GetLang())
+}
+
+//按指定语言返回 bankid 的说明
+func GetBankIdLang(bankid, l string) BankId {
+	bankIdCatalogMutex.RLock()
+	defer bankIdCatalogMutex.RUnlock()
+
+	bid := BankId{
+		BankId:  bankid,
+		Channel: BANK_CHANNEL_NONE,
+	}
+
+	if a, ok := bankIdCatalog.accounts[bankid]; ok {
+		bid.Channel = a.Channel
+		bid.CardType = a.CardType
+		bid.FundType = a.FundType
+		bid.Category = Message(l, MSG_BANK_CATEGORY_PREFIX+a.Channel)
+		if bid.Desc = localName(a.Name, l); bid.Desc == "" {
+			bid.Desc = Message(l, MSG_BANK_DESC_PREFIX+a.Channel)
+		}
+		if bid.FundType == "" {
+			bid.FundType = fundTypeOfChannel(a.Channel)
+		}
+		return bid
+	}
+
+	for _, s := range bankIdCatalog.suffixes {
+		if !strings.HasSuffix(bankid, s.Suffix) {
+			continue
+		}
+
+		bid.Channel = s.Channel
+		bid.CardType = s.CardType
+		bid.BankCode = strings.TrimSuffix(bankid, s.Suffix)
+		if b, ok := bankIdCatalog.banks[bid.BankCode]; ok {
+			bid.BankName = localName(b.Name, l)
+		}
+		break
+	}
+
+	bid.Category = Message(l, MSG_BANK_CATEGORY_PREFIX+bid.Channel)
+	bid.Desc = Message(l, MSG_BANK_DESC_PREFIX+bid.Channel)
+	bid.FundType = fundTypeOfChannel(bid.Channel)
+	return bid
+}
+
+//bankid 对应的银行名称.账户类的返回账户名称.都没有的返回 bankid 本身
+func BankName(bankid, l string) string {
+	bid := GetBankIdLang(bankid, l)
+	if bid.BankName != "" {
+		return bid.BankName
+	}
+	if bid.Channel == BANK_CHANNEL_BALANCE {
+		return bid.Desc
+	}
+	return bankid
+}
+
+func init() {
+	ResetBankIdCatalog()
+}
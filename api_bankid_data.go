@@ -0,0 +1,52 @@
+package openbestpay
+
+/**
+内置的 bankid 目录
+更新目录时同步修改 version
+*/
+const bankIdCatalogData = `{
+	"version": "2017.09.2",
+	"accounts": [
+		{"bankId": "COMPANYACC_3AC", "channel": "balance", "fundType": "discount", "name": {"zh": "立减优惠", "en": "instant discount"}},
+		{"bankId": "EPAYTRAVELACC_3AC", "channel": "balance", "name": {"zh": "翼游账户", "en": "Yiyou account"}},
+		{"bankId": "EPAYACC", "channel": "balance", "name": {"zh": "翼支付账户", "en": "Bestpay account"}},
+		{"bankId": "VOUCHER_3AC", "channel": "balance", "fundType": "voucher", "name": {"zh": "营销代金券", "en": "marketing voucher"}},
+		{"bankId": "BESTCARDOLD", "channel": "balance", "fundType": "card", "name": {"zh": "老翼支付卡", "en": "Bestpay card (old)"}},
+		{"bankId": "BESTCARD", "channel": "balance", "fundType": "card", "name": {"zh": "新翼支付卡", "en": "Bestpay card (new)"}},
+		{"bankId": "EPAYTRAVELCARD_PRE", "channel": "balance", "fundType": "card", "name": {"zh": "翼游卡", "en": "Yiyou card"}},
+		{"bankId": "EPAYACCWM", "channel": "balance", "name": {"zh": "翼支付无密账户", "en": "Bestpay password-free account"}}
+	],
+	"banks": [
+		{"code": "ICBC", "name": {"zh": "中国工商银行", "en": "Industrial and Commercial Bank of China"}},
+		{"code": "ABC", "name": {"zh": "中国农业银行", "en": "Agricultural Bank of China"}},
+		{"code": "BOC", "name": {"zh": "中国银行", "en": "Bank of China"}},
+		{"code": "CCB", "name": {"zh": "中国建设银行", "en": "China Construction Bank"}},
+		{"code": "COMM", "name": {"zh": "交通银行", "en": "Bank of Communications"}},
+		{"code": "CMB", "name": {"zh": "招商银行", "en": "China Merchants Bank"}},
+		{"code": "CEB", "name": {"zh": "中国光大银行", "en": "China Everbright Bank"}},
+		{"code": "CIB", "name": {"zh": "兴业银行", "en": "Industrial Bank"}},
+		{"code": "CITIC", "name": {"zh": "中信银行", "en": "China CITIC Bank"}},
+		{"code": "CMBC", "name": {"zh": "中国民生银行", "en": "China Minsheng Bank"}},
+		{"code": "SPDB", "name": {"zh": "浦发银行", "en": "Shanghai Pudong Development Bank"}},
+		{"code": "GDB", "name": {"zh": "广发银行", "en": "China Guangfa Bank"}},
+		{"code": "PAB", "name": {"zh": "平安银行", "en": "Ping An Bank"}},
+		{"code": "PSBC", "name": {"zh": "中国邮政储蓄银行", "en": "Postal Savings Bank of China"}},
+		{"code": "HXB", "name": {"zh": "华夏银行", "en": "Hua Xia Bank"}},
+		{"code": "BCCB", "name": {"zh": "北京银行", "en": "Bank of Beijing"}},
+		{"code": "BOS", "name": {"zh": "上海银行", "en": "Bank of Shanghai"}},
+		{"code": "NBCB", "name": {"zh": "宁波银行", "en": "Bank of Ningbo"}},
+		{"code": "HZCB", "name": {"zh": "杭州银行", "en": "Bank of Hangzhou"}},
+		{"code": "CZB", "name": {"zh": "浙商银行", "en": "China Zheshang Bank"}},
+		{"code": "SRCB", "name": {"zh": "上海农商银行", "en": "Shanghai Rural Commercial Bank"}}
+	],
+	"suffixes": [
+		{"suffix": "_RPB2C", "channel": "quick"},
+		{"suffix": "_QB2C", "channel": "quick"},
+		{"suffix": "_Q", "channel": "quick"},
+		{"suffix": "_B2B", "channel": "b2b"},
+		{"suffix": "B2B", "channel": "b2b"},
+		{"suffix": "_B2C", "channel": "b2c"},
+		{"suffix": "_C", "channel": "b2c", "cardType": "credit"},
+		{"suffix": "_D", "channel": "b2c", "cardType": "debit"}
+	]
+}`
@@ -1,10 +1,18 @@
 package openbestpay
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"html"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
 
 	"strings"
+	"time"
 
 	"reflect"
 
@@ -25,6 +33,32 @@ const (
 	BESTPAY_URL_COMMONREFUND = "https://webpaywg.bestpay.com.cn/refund/commonRefund"
 	// 撤单
 	BESTPAY_URL_REVERSE = "https://webpaywg.bestpay.com.cn/reverse/reverse"
+	// 订单关闭
+	BESTPAY_URL_CLOSEORDER = "https://webpaywg.bestpay.com.cn/close/closeOrder"
+	// 二维码支付(主扫) 用户扫描商户展示的二维码
+	BESTPAY_URL_QRCODE_PLACEORDER = "https://webpaywg.bestpay.com.cn/qrcode/placeOrder"
+	// H5 下单
+	BESTPAY_URL_H5_ORDER = "https://webpaywg.bestpay.com.cn/order.action"
+	// H5 收银台 页面跳转
+	BESTPAY_URL_H5_CASHIER = "https://webpaywg.bestpay.com.cn/payWap.do"
+	// App 下单
+	BESTPAY_URL_APP_ORDER = "https://webpaywg.bestpay.com.cn/app/placeOrder"
+	// PC 网关支付 页面跳转
+	BESTPAY_URL_GATEWAY_PAY = "https://webpaywg.bestpay.com.cn/payWeb.do"
+	// 委托代扣 签约
+	BESTPAY_URL_AGREEMENT_SIGN = "https://webpaywg.bestpay.com.cn/agreement/sign"
+	// 委托代扣 签约查询
+	BESTPAY_URL_AGREEMENT_QUERY = "https://webpaywg.bestpay.com.cn/agreement/query"
+	// 委托代扣 解约
+	BESTPAY_URL_AGREEMENT_CANCEL = "https://webpaywg.bestpay.com.cn/agreement/cancel"
+	// 委托代扣 扣款
+	BESTPAY_URL_AGREEMENT_DEDUCT = "https://webpaywg.bestpay.com.cn/agreement/deduct"
+	// 商户账户余额查询
+	BESTPAY_URL_ACCOUNT_BALANCE = "https://webpaywg.bestpay.com.cn/account/queryBalance"
+	// 商户结算查询
+	BESTPAY_URL_ACCOUNT_SETTLEMENT = "https://webpaywg.bestpay.com.cn/account/querySettlement"
+	// 分账结果查询
+	BESTPAY_URL_LEDGER_QUERY = "https://webpaywg.bestpay.com.cn/ledger/queryLedgerDetail"
 )
 
 type bizInterface interface {
@@ -32,6 +66,11 @@ type bizInterface interface {
 	tobe_mac() string
 }
 
+//有默认值的业务参数.在 SetBizContent 中签名之前填充
+type bizDefaulter interface {
+	defaults() bizInterface
+}
+
 type responseInterface interface{}
 
 type Response struct {
@@ -67,11 +106,14 @@ type Ledger map[string]int
 
 func (l Ledger) Set(subMchId string, amount int) error {
 	if len(subMchId) == 0 {
-		return errors.New("subMchId can not be nil")
+		return msgError(MSG_LEDGER_SUBMCH_NIL)
 	}
 
 	if amount == 0 {
-		return errors.New("amount can not be zero")
+		return msgError(MSG_LEDGER_AMT_ZERO)
+	}
+	if amount < 0 {
+		return msgError(MSG_LEDGER_MIN_AMT)
 	}
 
 	l[subMchId] = amount
@@ -94,32 +136,32 @@ func SetLedgers(total_amt int, legder Ledger) (string, error) {
 	*/
 
 	if n := len(legder); n == 0 {
-		return "", errors.New("legder is nil")
+		return "", msgError(MSG_LEDGER_NIL)
 	} else if n > 10 {
-		return "", errors.New("legder max number is ten")
+		return "", msgError(MSG_LEDGER_MAX_NUM)
 	}
 
 	//分账商户必须是分账支付商户的子商户、这个暂时无法判断.交给对方去处理.
 	//分账金额必须大于 0 分，最小 分账单位为 1 分、
 	if total_amt == 0 {
-		return "", errors.New("total amount is zero")
+		return "", msgError(MSG_LEDGER_TOTAL_ZERO)
 	}
 
 	ret := ""
 	for subMchId, amount := range legder {
 		if amount < 1 {
-			return "", errors.New("per legder min amount is 1")
+			return "", msgError(MSG_LEDGER_MIN_AMT)
 		}
 		total_amt -= amount
 		ret += fmt.Sprintf("%s:%d|", subMchId, amount)
 	}
 
 	if total_amt != 0 {
-		return "", errors.New("total amount not equal sum(legder amount)")
+		return "", msgError(MSG_LEDGER_TOTAL_EQUAL)
 	}
 
 	if len(ret) <= 1 {
-		return "", errors.New("system error")
+		return "", msgError(MSG_SYSTEM_ERROR)
 	}
 
 	ret = ret[:len(ret)-1]
@@ -127,122 +169,41 @@ func SetLedgers(total_amt int, legder Ledger) (string, error) {
 	return ret, nil
 }
 
-/**
-BANKID 的字段说明
-输入接口响应过来的 bankid.. 返回对应的说明
-*/
-type BankId struct {
-	Category string //类别
-	BankId   string //bankId 字段.
-	Desc     string //具体说明
-}
-
-func GetBankId(bankid string) (bid BankId) {
-	switch bankid {
-	case "COMPANYACC_3AC":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "立减优惠",
-		}
-		break
-	case "EPAYTRAVELACC_3AC":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "翼游账户",
-		}
-		break
-	case "EPAYACC":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "翼支付账户",
-		}
-		break
-	case "VOUCHER_3AC":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "营销代金券",
-		}
-		break
-	case "BESTCARDOLD":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "老翼支付卡",
-		}
-		break
-	case "BESTCARD":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "新翼支付卡",
-		}
-		break
-	case "EPAYTRAVELCARD_PRE":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "翼游卡",
-		}
-		break
-	case "EPAYACCWM":
-		bid = BankId{
-			Category: "个账余额",
-			BankId:   bankid,
-			Desc:     "翼支付无密账户",
-		}
-		break
-	default:
-		bid.BankId = bankid
-		//其它的均归类于这里...
-		if strings.HasSuffix(bankid, "_RPB2C") ||
-			strings.HasSuffix(bankid, "_QB2C") ||
-			strings.HasSuffix(bankid, "_Q") {
-			bid.Category = "快捷支付"
-			bid.Desc = "快捷支付类型"
-		} else if strings.HasSuffix(bankid, "_B2B") ||
-			strings.HasSuffix(bankid, "B2B") {
-			bid.Category = "企业网银"
-			bid.Desc = "对公业务类型"
-		} else if strings.HasSuffix(bankid, "_B2C") ||
-			strings.HasSuffix(bankid, "_C") ||
-			strings.HasSuffix(bankid, "_D") {
-			bid.Category = "个人网银"
-			bid.Desc = "对私业务类型"
-		} else {
-			bid = BankId{
-				Category: "无",
-				BankId:   bankid,
-				Desc:     "无此信息",
-			}
-		}
-		break
-	}
-
-	return bid
-}
-
 type BestpayApi struct {
 	Key       string //bestpay 针对每个商户申请之后都会有一个秘钥..需要进行配置.
 	params    bizInterface
 	apiname   func() string
 	apimethod func() string
+	raw       string //网关返回的原始数据
+	attempts  int    //执行次数.见 RunRetry
+	ctx       context.Context
 }
 
 func (b *BestpayApi) SetBizContent(biz bizInterface, key string) error {
+	return b.SetBizContentContext(b.runContext(), biz, key)
+}
+
+//同 SetBizContent.ctx 用于退款检查时的交易查询(见 SetRefundGuard)
+func (b *BestpayApi) SetBizContentContext(ctx context.Context, biz bizInterface, key string) error {
 	if key == "" {
-		return errors.New("key is nil")
+		return msgError(MSG_KEY_NIL)
 	}
 
 	b.Key = key
 
+	if d, ok := biz.(bizDefaulter); ok {
+		biz = d.defaults()
+	}
+
 	if err := biz.valid(); err != nil {
 		return err
 	}
 
+	//退款金额检查.见 SetRefundGuard
+	if err := guardRefund(ctx, biz); err != nil {
+		return err
+	}
+
 	b.params = biz
 
 	return nil
@@ -259,22 +220,33 @@ func (b *BestpayApi) mac() string {
 	return strings.ToUpper(_sign)
 }
 
+//带 ctx 的请求使用.超时与 httplib 的默认值一致
+var httpClient = &http.Client{Timeout: 60 * time.Second}
+
 /**
 请求
+ctx 可以取消的(见 WithContext).ctx 结束时请求立即返回
 */
-func (b *BestpayApi) request(m map[string]interface{}) (string, error) {
+func (b *BestpayApi) request(ctx context.Context, m map[string]interface{}) (string, error) {
 	url_link := b.apimethod()
 	logs.Debug(fmt.Sprintf("==[request params]==[%s]", url_link))
 	http_request := httplib.Post(url_link)
+	values := url.Values{}
 	tmp_string := ""
 	for k, _ := range m {
 		value := fmt.Sprintf("%v", m[k])
 		if value != "" {
 			http_request.Param(k, value)
+			values.Set(k, value)
 			tmp_string = tmp_string + k + "=" + value + "\t"
 		}
 	}
 	logs.Debug(fmt.Sprintf("==[reuest params]==[%s]", tmp_string))
+
+	if ctx != nil && ctx.Done() != nil {
+		return post_context(ctx, url_link, values)
+	}
+
 	var string_result string
 	if v, err := http_request.String(); err != nil {
 		return "", err
@@ -285,6 +257,26 @@ func (b *BestpayApi) request(m map[string]interface{}) (string, error) {
 	return string_result, nil
 }
 
+func post_context(ctx context.Context, url_link string, values url.Values) (string, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, url_link, strings.NewReader(values.Encode()))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return string(body), nil
+}
+
 func (b *BestpayApi) struct_to_map() map[string]interface{} {
 	t := reflect.TypeOf(b.params)
 	v := reflect.ValueOf(b.params)
@@ -293,7 +285,10 @@ func (b *BestpayApi) struct_to_map() map[string]interface{} {
 	for i := 0; i < t.NumField(); i++ {
 		key := t.Field(i).Name
 		value := v.Field(i).Interface()
-		tag := t.Field(i).Tag.Get("ali")
+		tag := t.Field(i).Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
 		if tag != "" {
 			if strings.Contains(tag, ",") {
 				ps := strings.Split(tag, ",")
@@ -302,16 +297,102 @@ func (b *BestpayApi) struct_to_map() map[string]interface{} {
 				key = tag
 			}
 		}
+		//商品详情之类的字段.接口要求以 json 格式传过去
+		switch v.Field(i).Kind() {
+		case reflect.Slice, reflect.Map:
+			if v.Field(i).Len() == 0 {
+				value = ""
+				break
+			}
+			fallthrough
+		case reflect.Struct:
+			if bs, err := json.Marshal(value); err == nil {
+				value = string(bs)
+			}
+		}
 		data[key] = value
 	}
 	return data
 }
 
+//签名之后的参数.值为空的不传
+func (b *BestpayApi) signed_params() (map[string]string, error) {
+	if b.params == nil {
+		return nil, msgError(MSG_FIELD_NIL, "biz content")
+	}
+
+	m := b.struct_to_map()
+	m["mac"] = b.mac()
+
+	params := make(map[string]string, len(m))
+	for k := range m {
+		value := fmt.Sprintf("%v", m[k])
+		if value != "" {
+			params[k] = value
+		}
+	}
+	return params, nil
+}
+
+/**
+页面跳转类的接口(如 H5 收银台).不需要服务端发请求.
+生成带签名的跳转链接.直接重定向用户浏览器即可
+*/
+func (b *BestpayApi) RedirectUrl() (string, error) {
+	params, err := b.signed_params()
+	if err != nil {
+		return "", err
+	}
+
+	values := url.Values{}
+	for k, v := range params {
+		values.Set(k, v)
+	}
+	return b.apimethod() + "?" + values.Encode(), nil
+}
+
+/**
+页面跳转类的接口.生成自动提交的 html 表单.直接输出给用户浏览器即可
+*/
+func (b *BestpayApi) HtmlForm() (string, error) {
+	params, err := b.signed_params()
+	if err != nil {
+		return "", err
+	}
+
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	form := `<form id="bestpaysubmit" name="bestpaysubmit" action="` + html.EscapeString(b.apimethod()) + `" method="POST">`
+	for _, k := range keys {
+		form += `<input type="hidden" name="` + html.EscapeString(k) + `" value="` + html.EscapeString(params[k]) + `"/>`
+	}
+	form += `</form><script>document.forms['bestpaysubmit'].submit();</script>`
+	return form, nil
+}
+
 func (b *BestpayApi) Run() error {
+	return b.run(b.runContext())
+}
+
+//WithContext 设置的 ctx.没有设置的使用 context.Background()
+func (b *BestpayApi) runContext() context.Context {
+	if b.ctx == nil {
+		return context.Background()
+	}
+	return b.ctx
+}
+
+func (b *BestpayApi) run(ctx context.Context) error {
 	defer logs.Debug("==bestpay api end=====================")
 	logs.Debug("==bestpay api start=====================")
 	logs.Debug(fmt.Sprintf("==[method]==[%s]:[%s]", b.apiname(), b.apimethod()))
 
+	b.attempts = 1
+
 	//做mac签名
 	sign := b.mac()
 	logs.Debug(fmt.Sprintf("==[sign result]==[%s]", sign))
@@ -320,13 +401,75 @@ func (b *BestpayApi) Run() error {
 	m := b.struct_to_map()
 	m["mac"] = sign
 
-	result_string := ""
-	if v, err := b.request(m); err != nil {
+	inv := &Invocation{
+		Ctx:     ctx,
+		ApiName: b.apiname(),
+		Method:  b.apimethod(),
+		Biz:     b.params,
+		Params:  m,
+	}
+	//复用同一个 api 时.失败之后不能留着上一次的响应
+	b.raw = ""
+
+	start := time.Now()
+	err := chainInterceptors(b.invoke)(inv)
+	b.audit(inv, start, err)
+	if err != nil {
 		return err
-	} else {
-		result_string = v
-		logs.Debug(fmt.Sprintf("==[response]==[%s]", result_string))
 	}
+	logs.Debug(fmt.Sprintf("==[response]==[%s]", inv.Raw))
+
+	b.raw = inv.Raw
 
 	return nil
 }
+
+//网关返回的原始数据.Run 之后才有
+func (b *BestpayApi) Raw() string {
+	return b.raw
+}
+
+/**
+解析响应
+result 传对应接口的 Resp_* 结构体指针.网关返回的 result 会解析到里面
+网关返回 success 不为 true 的时候返回错误.错误信息见 Response.Message
+*/
+func (b *BestpayApi) Response(result interface{}) (Response, error) {
+	resp := Response{Result: result}
+	if b.raw == "" {
+		return resp, msgError(MSG_GATEWAY_EMPTY_RESPONSE)
+	}
+
+	//success 可能是 true 也可能是 "true".先按原始类型取出来
+	var tmp struct {
+		Success   interface{}     `json:"success"`
+		ErrorCode string          `json:"errorCode"`
+		ErrorMsg  string          `json:"errorMsg"`
+		Result    json.RawMessage `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(b.raw), &tmp); err != nil {
+		return resp, msgError(MSG_GATEWAY_INVALID_RESULT, err.Error())
+	}
+
+	if tmp.Success != nil {
+		resp.Success = fmt.Sprintf("%v", tmp.Success)
+	}
+	resp.ErrorCode = tmp.ErrorCode
+	resp.ErrorMsg = tmp.ErrorMsg
+
+	if result != nil && len(tmp.Result) > 0 && string(tmp.Result) != "null" {
+		if err := json.Unmarshal(tmp.Result, result); err != nil {
+			return resp, msgError(MSG_GATEWAY_INVALID_RESULT, err.Error())
+		}
+	}
+
+	if resp.Success != "true" {
+		//没有 errorCode 也没有 errorMsg 的时候不能返回空的错误
+		if m := resp.Message(GetLang()); m != "" {
+			return resp, errors.New(m)
+		}
+		return resp, msgError(MSG_GATEWAY_UNKNOWN_ERROR, "success="+resp.Success)
+	}
+
+	return resp, nil
+}
@@ -0,0 +1,374 @@
+package openbestpay
+
+import (
+	"bufio"
+	"context"
+	"encoding/csv"
+	"encoding/json"
+	"io"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+/**
+批量退款
+	br := NewBatchRefund(key)
+	br.Concurrency = 4                                   //同时进行的退款数
+	br.Rate = 10                                         //每秒最多发起的退款数
+	br.Progress = NewFileRefundProgress("refund.progress") //进度文件.中断之后用同一个文件重新执行即可
+	br.Retry = DefaultRetryPolicy()                      //单笔退款的重试策略.按 refundReqNo 幂等
+	results, err := br.Run(ctx, refunds)
+	WriteRefundReport(os.Stdout, results)
+已经成功的退款(按 refundReqNo)不会重复执行.失败的会重新执行.
+同一个 refundReqNo 重复提交网关不会重复退款.所以重新执行是安全的
+ctx 结束(如 Ctrl+C)之后不再发起新的退款.已经发起的执行完再返回.用同一个进度文件重新执行即可
+*/
+
+//单笔退款的结果
+type RefundResult struct {
+	OldOrderNo  string                    `json:"oldOrderNo"`
+	RefundReqNo string                    `json:"refundReqNo"`
+	TransAmt    int                       `json:"transAmt"`
+	Success     bool                      `json:"success"`
+	ErrorCode   string                    `json:"errorCode,omitempty"`
+	ErrorMsg    string                    `json:"errorMsg,omitempty"`
+	Result      Resp_bestpay_commonrefund `json:"result"`
+	Attempts    int                       `json:"attempts,omitempty"` //执行次数.见 RunRetry
+	Time        string                    `json:"time"`               //执行时间 yyyyMMddhhmmss
+}
+
+//退款进度的存储.用于中断之后继续执行
+type RefundProgress interface {
+	//已经保存的结果.key 为 refundReqNo
+	Load() (map[string]RefundResult, error)
+	//保存一笔退款的结果
+	Save(r RefundResult) error
+}
+
+type BatchRefund struct {
+	Key         string         //商户秘钥
+	Concurrency int            //同时进行的退款数.默认 1
+	Rate        int            //每秒最多发起的退款数.0 不限制.最大 1e9
+	Progress    RefundProgress //进度存储.为空时不保存进度
+	Retry       RetryPolicy    //单笔退款的重试策略.默认 DefaultRetryPolicy
+
+	refund func(biz Biz_bestpay_commonrefund, key string) RefundResult
+}
+
+func NewBatchRefund(key string) *BatchRefund {
+	return &BatchRefund{
+		Key:         key,
+		Concurrency: 1,
+		Retry:       DefaultRetryPolicy(),
+	}
+}
+
+//执行一笔退款.ctx 只用于退款检查(见 SetRefundGuard)
+func commonRefund(ctx context.Context, biz Biz_bestpay_commonrefund, key string, p RetryPolicy) RefundResult {
+	r := RefundResult{
+		OldOrderNo:  biz.OldOrderNo,
+		RefundReqNo: biz.RefundReqNo,
+		TransAmt:    biz.TransAmt,
+		Time:        time.Now().Format("20060102150405"),
+	}
+
+	api := GetApi(BESTPAY_URL_COMMONREFUND)
+	if err := api.SetBizContentContext(ctx, biz, key); err != nil {
+		r.ErrorMsg = err.Error()
+		return r
+	}
+
+	//不使用 Run 的 ctx.已经发起的退款中途取消的话结果不确定
+	err := api.RunRetry(p)
+	r.Attempts = api.Attempts()
+	if err != nil {
+		r.ErrorMsg = err.Error()
+		return r
+	}
+
+	resp, err := api.Response(&r.Result)
+	r.ErrorCode = resp.ErrorCode
+	if err != nil {
+		r.ErrorMsg = err.Error()
+		return r
+	}
+
+	r.Success = true
+	return r
+}
+
+//没有执行的退款.ErrorMsg 说明原因
+func skippedRefund(biz Biz_bestpay_commonrefund, key string) RefundResult {
+	return RefundResult{
+		OldOrderNo:  biz.OldOrderNo,
+		RefundReqNo: biz.RefundReqNo,
+		TransAmt:    biz.TransAmt,
+		ErrorMsg:    msg(key),
+	}
+}
+
+/**
+执行批量退款.返回的结果与 refunds 的顺序一致
+进度保存失败的时候停止执行.返回所有结果和错误.没有执行的 ErrorMsg 为 MSG_REFUND_NOT_RUN
+ctx 结束的时候停止发起新的退款.已经发起的执行完.返回所有结果和 ctx.Err().没有执行的 ErrorMsg 为 MSG_REFUND_CANCELLED
+*/
+func (b *BatchRefund) Run(ctx context.Context, refunds []Biz_bestpay_commonrefund) ([]RefundResult, error) {
+	if b.Key == "" {
+		return nil, msgError(MSG_KEY_NIL)
+	}
+
+	done := map[string]RefundResult{}
+	if b.Progress != nil {
+		v, err := b.Progress.Load()
+		if err != nil {
+			return nil, err
+		}
+		done = v
+	}
+
+	refund := b.refund
+	if refund == nil {
+		refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+			return commonRefund(ctx, biz, key, b.Retry)
+		}
+	}
+
+	concurrency := b.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	var tick <-chan time.Time
+	if b.Rate > 0 {
+		//超过 1e9 时间隔会变成 0.NewTicker 会 panic
+		rate := b.Rate
+		if rate > int(time.Second) {
+			rate = int(time.Second)
+		}
+		ticker := time.NewTicker(time.Second / time.Duration(rate))
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	results := make([]RefundResult, len(refunds))
+	executed := make([]bool, len(refunds))
+	jobs := make(chan int)
+	stop := make(chan struct{})
+
+	var (
+		wg      sync.WaitGroup
+		mutex   sync.Mutex
+		saveErr error
+	)
+
+	for i := 0; i < concurrency; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for idx := range jobs {
+				r := refund(refunds[idx], b.Key)
+				results[idx] = r
+				executed[idx] = true
+
+				if b.Progress == nil {
+					continue
+				}
+
+				mutex.Lock()
+				if err := b.Progress.Save(r); err != nil && saveErr == nil {
+					saveErr = err
+					close(stop)
+				}
+				mutex.Unlock()
+			}
+		}()
+	}
+
+	seen := map[string]bool{}
+	cancelled := false
+loop:
+	for idx, biz := range refunds {
+		//同一批里面 refundReqNo 重复的只执行一次.已经成功的也只计一次
+		if seen[biz.RefundReqNo] {
+			results[idx] = skippedRefund(biz, MSG_REFUND_DUPLICATED)
+			executed[idx] = true
+			continue
+		}
+		seen[biz.RefundReqNo] = true
+
+		if r, ok := done[biz.RefundReqNo]; ok && r.Success {
+			results[idx] = r
+			executed[idx] = true
+			continue
+		}
+
+		if ctx.Err() != nil {
+			cancelled = true
+			break
+		}
+
+		if tick != nil {
+			select {
+			case <-tick:
+			case <-stop:
+				break loop
+			case <-ctx.Done():
+				cancelled = true
+				break loop
+			}
+		}
+
+		select {
+		case jobs <- idx:
+		case <-stop:
+			break loop
+		case <-ctx.Done():
+			cancelled = true
+			break loop
+		}
+	}
+	close(jobs)
+	wg.Wait()
+
+	for idx, biz := range refunds {
+		if executed[idx] {
+			continue
+		}
+		if saveErr != nil {
+			results[idx] = skippedRefund(biz, MSG_REFUND_NOT_RUN)
+		} else {
+			results[idx] = skippedRefund(biz, MSG_REFUND_CANCELLED)
+		}
+	}
+
+	if saveErr == nil && cancelled {
+		return results, ctx.Err()
+	}
+	return results, saveErr
+}
+
+/**
+文件形式的退款进度.每行一个 json.只追加不修改
+同一个 refundReqNo 有多行的以最后一行为准
+*/
+type FileRefundProgress struct {
+	path  string
+	mutex sync.Mutex
+}
+
+func NewFileRefundProgress(path string) *FileRefundProgress {
+	return &FileRefundProgress{path: path}
+}
+
+func (f *FileRefundProgress) Load() (map[string]RefundResult, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	done := map[string]RefundResult{}
+	file, err := os.Open(f.path)
+	if os.IsNotExist(err) {
+		return done, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		line := scanner.Bytes()
+		if len(line) == 0 {
+			continue
+		}
+
+		var r RefundResult
+		if err := json.Unmarshal(line, &r); err != nil {
+			//程序崩溃时最后一行可能没有写完整.忽略即可.这笔退款会重新执行
+			continue
+		}
+		done[r.RefundReqNo] = r
+	}
+
+	return done, scanner.Err()
+}
+
+func (f *FileRefundProgress) Save(r RefundResult) error {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+
+	if r.RefundReqNo == "" {
+		return msgError(MSG_FIELD_NIL, "refundReqNo")
+	}
+
+	b, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(f.path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+
+	if _, err := file.Write(append(b, '\n')); err != nil {
+		file.Close()
+		return err
+	}
+
+	//每一笔都落盘.避免崩溃之后丢失进度
+	if err := file.Sync(); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+//批量退款结果的汇总
+type RefundSummary struct {
+	Total      int //总笔数
+	Success    int //成功笔数
+	Fail       int //失败笔数
+	SuccessAmt int //成功金额 单位:分
+	FailAmt    int //失败金额 单位:分
+}
+
+func SummarizeRefunds(results []RefundResult) RefundSummary {
+	s := RefundSummary{Total: len(results)}
+	for _, r := range results {
+		if r.Success {
+			s.Success++
+			s.SuccessAmt += r.TransAmt
+		} else {
+			s.Fail++
+			s.FailAmt += r.TransAmt
+		}
+	}
+	return s
+}
+
+//输出 csv 格式的退款报告.每笔一行.汇总见 SummarizeRefunds
+func WriteRefundReport(w io.Writer, results []RefundResult) error {
+	cw := csv.NewWriter(w)
+	if err := cw.Write([]string{"oldOrderNo", "refundReqNo", "transAmt", "success", "errorCode", "errorMsg", "time"}); err != nil {
+		return err
+	}
+
+	for _, r := range results {
+		if err := cw.Write([]string{
+			r.OldOrderNo,
+			r.RefundReqNo,
+			strconv.Itoa(r.TransAmt),
+			strconv.FormatBool(r.Success),
+			r.ErrorCode,
+			r.ErrorMsg,
+			r.Time,
+		}); err != nil {
+			return err
+		}
+	}
+
+	cw.Flush()
+	return cw.Error()
+}
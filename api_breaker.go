@@ -0,0 +1,400 @@
+package openbestpay
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+熔断和限流
+网关异常时避免请求堆积.默认都不开启
+	SetCircuitBreaker(NewCircuitBreaker(BreakerConfig{FailureThreshold: 5, OpenTimeout: 30 * time.Second}))
+	SetRateLimiter(NewTokenBucket(50, 100, 0))
+熔断按接口和商户分别统计.key 为 endpoint:接口地址 和 merchant:merchantId.任何一个熔断都会拒绝请求
+只有网络错误或者网关没有返回数据才算失败.业务错误(如余额不足)不算
+被拒绝的请求返回 *GuardError.不会发送到网关.RunRetry 也不会重试
+*/
+
+//熔断状态
+const (
+	BREAKER_CLOSED    = "closed"    //正常
+	BREAKER_OPEN      = "open"      //熔断中.拒绝所有请求
+	BREAKER_HALF_OPEN = "half_open" //熔断超时之后.放少量请求试探
+)
+
+//请求被拒绝的原因
+const (
+	GUARD_CIRCUIT_OPEN = "circuit_open"
+	GUARD_RATE_LIMITED = "rate_limited"
+)
+
+//请求被熔断或者限流
+type GuardError struct {
+	Reason string //GUARD_*
+	Key    string //熔断的 key.限流的为空
+}
+
+func (e *GuardError) Error() string {
+	if e.Reason == GUARD_CIRCUIT_OPEN {
+		return msg(MSG_CIRCUIT_OPEN, e.Key)
+	}
+	return msg(MSG_RATE_LIMITED)
+}
+
+type BreakerConfig struct {
+	FailureThreshold int           //连续失败多少次之后熔断.默认 5
+	OpenTimeout      time.Duration //熔断多久之后进入半开.默认 30s
+	HalfOpenMax      int           //半开时同时放行的请求数.默认 1
+
+	//状态变化时回调.用于监控.回调时不持有锁
+	OnStateChange func(key, from, to string)
+}
+
+//某个 key 的熔断状态
+type BreakerState struct {
+	Key      string
+	State    string    //BREAKER_*
+	Failures int       //连续失败次数
+	OpenedAt time.Time //最近一次熔断的时间
+}
+
+type circuit struct {
+	state    string
+	failures int
+	openedAt time.Time
+	inflight int //半开时已经放行的请求
+}
+
+type CircuitBreaker struct {
+	config   BreakerConfig
+	mutex    sync.Mutex
+	circuits map[string]*circuit
+}
+
+//测试时替换
+var breakerNow = time.Now
+
+func NewCircuitBreaker(c BreakerConfig) *CircuitBreaker {
+	if c.FailureThreshold < 1 {
+		c.FailureThreshold = 5
+	}
+	if c.OpenTimeout <= 0 {
+		c.OpenTimeout = 30 * time.Second
+	}
+	if c.HalfOpenMax < 1 {
+		c.HalfOpenMax = 1
+	}
+	return &CircuitBreaker{
+		config:   c,
+		circuits: map[string]*circuit{},
+	}
+}
+
+//一次请求对应的熔断 key
+func BreakerKeys(method, merchantId string) []string {
+	keys := []string{"endpoint:" + method}
+	if merchantId != "" {
+		keys = append(keys, "merchant:"+merchantId)
+	}
+	return keys
+}
+
+type stateChange struct {
+	key, from, to string
+}
+
+func (cb *CircuitBreaker) get(key string) *circuit {
+	c, ok := cb.circuits[key]
+	if !ok {
+		c = &circuit{state: BREAKER_CLOSED}
+		cb.circuits[key] = c
+	}
+	return c
+}
+
+func (cb *CircuitBreaker) set(changes []stateChange, key string, c *circuit, state string) []stateChange {
+	if c.state == state {
+		return changes
+	}
+	changes = append(changes, stateChange{key, c.state, state})
+	c.state = state
+	return changes
+}
+
+func (cb *CircuitBreaker) notify(changes []stateChange) {
+	if cb.config.OnStateChange == nil {
+		return
+	}
+	for _, c := range changes {
+		cb.config.OnStateChange(c.key, c.from, c.to)
+	}
+}
+
+/**
+请求之前调用.所有 key 都允许时才放行
+放行之后必须调用 Done
+*/
+func (cb *CircuitBreaker) Allow(keys ...string) error {
+	cb.mutex.Lock()
+	now := breakerNow()
+	changes := []stateChange{}
+
+	var reject error
+	for _, key := range keys {
+		c := cb.get(key)
+		if c.state == BREAKER_OPEN && now.Sub(c.openedAt) >= cb.config.OpenTimeout {
+			changes = cb.set(changes, key, c, BREAKER_HALF_OPEN)
+			c.inflight = 0
+		}
+		if c.state == BREAKER_OPEN || (c.state == BREAKER_HALF_OPEN && c.inflight >= cb.config.HalfOpenMax) {
+			reject = &GuardError{Reason: GUARD_CIRCUIT_OPEN, Key: key}
+			break
+		}
+	}
+
+	if reject == nil {
+		for _, key := range keys {
+			if c := cb.get(key); c.state == BREAKER_HALF_OPEN {
+				c.inflight++
+			}
+		}
+	}
+	cb.mutex.Unlock()
+
+	cb.notify(changes)
+	return reject
+}
+
+//记录请求的结果.failed 为 true 表示网关不可用
+func (cb *CircuitBreaker) Done(failed bool, keys ...string) {
+	cb.mutex.Lock()
+	now := breakerNow()
+	changes := []stateChange{}
+
+	for _, key := range keys {
+		c := cb.get(key)
+		if c.state == BREAKER_HALF_OPEN && c.inflight > 0 {
+			c.inflight--
+		}
+
+		if !failed {
+			c.failures = 0
+			changes = cb.set(changes, key, c, BREAKER_CLOSED)
+			continue
+		}
+
+		c.failures++
+		if c.state == BREAKER_HALF_OPEN || c.failures >= cb.config.FailureThreshold {
+			c.openedAt = now
+			changes = cb.set(changes, key, c, BREAKER_OPEN)
+		}
+	}
+	cb.mutex.Unlock()
+
+	cb.notify(changes)
+}
+
+//某个 key 的状态
+func (cb *CircuitBreaker) State(key string) BreakerState {
+	cb.mutex.Lock()
+	defer cb.mutex.Unlock()
+
+	s := BreakerState{Key: key, State: BREAKER_CLOSED}
+	if c, ok := cb.circuits[key]; ok {
+		s.State = c.state
+		s.Failures = c.failures
+		s.OpenedAt = c.openedAt
+	}
+	return s
+}
+
+//所有 key 的状态.按 key 排序
+func (cb *CircuitBreaker) States() []BreakerState {
+	cb.mutex.Lock()
+	keys := make([]string, 0, len(cb.circuits))
+	for key := range cb.circuits {
+		keys = append(keys, key)
+	}
+	cb.mutex.Unlock()
+
+	sort.Strings(keys)
+	states := make([]BreakerState, 0, len(keys))
+	for _, key := range keys {
+		states = append(states, cb.State(key))
+	}
+	return states
+}
+
+//恢复某个 key 为正常状态
+func (cb *CircuitBreaker) Reset(key string) {
+	cb.mutex.Lock()
+	changes := []stateChange{}
+	if c, ok := cb.circuits[key]; ok {
+		changes = cb.set(changes, key, c, BREAKER_CLOSED)
+		delete(cb.circuits, key)
+	}
+	cb.mutex.Unlock()
+
+	cb.notify(changes)
+}
+
+/**
+令牌桶限流
+每秒补充 rate 个令牌.最多 burst 个
+*/
+type TokenBucket struct {
+	rate    float64
+	burst   float64
+	maxWait time.Duration
+	tokens  float64
+	last    time.Time
+	mutex   sync.Mutex
+}
+
+//maxWait 为没有令牌时最多等待的时间.0 不等待直接拒绝
+func NewTokenBucket(rate float64, burst int, maxWait time.Duration) *TokenBucket {
+	if burst < 1 {
+		burst = 1
+	}
+	return &TokenBucket{
+		rate:    rate,
+		burst:   float64(burst),
+		maxWait: maxWait,
+		tokens:  float64(burst),
+		last:    breakerNow(),
+	}
+}
+
+func (t *TokenBucket) refill(now time.Time) {
+	if elapsed := now.Sub(t.last).Seconds(); elapsed > 0 {
+		t.tokens += elapsed * t.rate
+		if t.tokens > t.burst {
+			t.tokens = t.burst
+		}
+	}
+	t.last = now
+}
+
+/**
+取一个令牌.有令牌时立即返回 0
+没有令牌时返回需要等待的时间.等待时间不超过 maxWait 的预先扣除令牌
+返回 false 表示被拒绝
+*/
+func (t *TokenBucket) reserve() (time.Duration, bool) {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.refill(breakerNow())
+	if t.tokens >= 1 {
+		t.tokens--
+		return 0, true
+	}
+	if t.rate <= 0 {
+		return 0, false
+	}
+
+	wait := time.Duration((1 - t.tokens) / t.rate * float64(time.Second))
+	if wait > t.maxWait {
+		return 0, false
+	}
+	t.tokens--
+	return wait, true
+}
+
+//等待时 ctx 结束.预先扣除的令牌还回去
+func (t *TokenBucket) cancel() {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.refill(breakerNow())
+	if t.tokens++; t.tokens > t.burst {
+		t.tokens = t.burst
+	}
+}
+
+//测试时替换
+var limiterSleep = sleepContext
+
+/**
+取一个令牌.需要等待时阻塞
+被拒绝时返回 *GuardError.等待时 ctx 结束返回 ctx.Err()
+*/
+func (t *TokenBucket) Take(ctx context.Context) error {
+	wait, ok := t.reserve()
+	if !ok {
+		return &GuardError{Reason: GUARD_RATE_LIMITED}
+	}
+	if wait > 0 {
+		if err := limiterSleep(ctx, wait); err != nil {
+			t.cancel()
+			return err
+		}
+	}
+	return nil
+}
+
+//当前可用的令牌数
+func (t *TokenBucket) Tokens() float64 {
+	t.mutex.Lock()
+	defer t.mutex.Unlock()
+
+	t.refill(breakerNow())
+	return t.tokens
+}
+
+var (
+	circuitBreaker *CircuitBreaker
+	rateLimiter    *TokenBucket
+	guardMutex     sync.RWMutex
+)
+
+//设置全局的熔断器.nil 关闭熔断
+func SetCircuitBreaker(cb *CircuitBreaker) {
+	guardMutex.Lock()
+	circuitBreaker = cb
+	guardMutex.Unlock()
+}
+
+func GetCircuitBreaker() *CircuitBreaker {
+	guardMutex.RLock()
+	defer guardMutex.RUnlock()
+	return circuitBreaker
+}
+
+//设置全局的限流.nil 关闭限流
+func SetRateLimiter(t *TokenBucket) {
+	guardMutex.Lock()
+	rateLimiter = t
+	guardMutex.Unlock()
+}
+
+func GetRateLimiter() *TokenBucket {
+	guardMutex.RLock()
+	defer guardMutex.RUnlock()
+	return rateLimiter
+}
+
+//经过限流和熔断之后再发送请求
+func (b *BestpayApi) guarded(ctx context.Context, m map[string]interface{}) (string, error) {
+	if limiter := GetRateLimiter(); limiter != nil {
+		if err := limiter.Take(ctx); err != nil {
+			return "", err
+		}
+	}
+
+	cb := GetCircuitBreaker()
+	if cb == nil {
+		return b.request(ctx, m)
+	}
+
+	keys := BreakerKeys(b.apimethod(), bizField(b.params, "MerchantId"))
+	if err := cb.Allow(keys...); err != nil {
+		return "", err
+	}
+
+	raw, err := b.request(ctx, m)
+	cb.Done(err != nil || raw == "", keys...)
+	return raw, err
+}
@@ -0,0 +1,108 @@
+package openbestpay
+
+import (
+	"fmt"
+)
+
+/**
+PC 网关支付
+https://webpaywg.bestpay.com.cn/payWeb.do
+页面跳转.用 RedirectUrl 或者 HtmlForm 生成.不要调用 Run
+bankId 为空时用户在翼支付收银台选择支付方式.
+bankId 不为空时直接跳转到对应的银行.如 ICBC_B2C CCB_B2B ICBC_Q
+*/
+type bestpay_gateway_pay struct {
+	BestpayApi
+}
+
+func (a *bestpay_gateway_pay) apiMethod() string {
+	return BESTPAY_URL_GATEWAY_PAY
+}
+
+func (a *bestpay_gateway_pay) apiName() string {
+	return "网关支付"
+}
+
+//网关支付允许直连的 bankId 渠道类别
+var gatewayBankChannels = []string{
+	BANK_CHANNEL_B2C,
+	BANK_CHANNEL_B2B,
+	BANK_CHANNEL_QUICK,
+}
+
+//网关支付允许直连的 bankId 渠道类别.返回的是副本
+func GatewayBankChannels() []string {
+	return append([]string{}, gatewayBankChannels...)
+}
+
+type Biz_bestpay_gateway_pay struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，全局唯一 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额
+	ProductAmt    int    `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int    `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	BankId        string `json:"bankId,omitempty" bestpay:"max=30"`                          //直连银行.为空时由用户在收银台选择 30
+	BusiType      string `json:"busiType,omitempty"`                                         //默认填:0000001
+	PageUrl       string `json:"pageUrl,omitempty" bestpay:"required,max=255"`               //支付完成之后用户浏览器跳转的地址 255
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	LedgerDetail  string `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //分账明细 256
+	ClientIp      string `json:"clientIp,omitempty" bestpay:"max=64"`                        //用户的 ip 64
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_gateway_pay) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+//busiType 没有填的时候使用默认值
+func (b Biz_bestpay_gateway_pay) defaults() bizInterface {
+	if b.BusiType == "" {
+		b.BusiType = "0000001"
+	}
+	return b
+}
+
+func (b Biz_bestpay_gateway_pay) valid() error {
+	ve := validStruct(b)
+
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
+	}
+
+	if b.BankId != "" {
+		bid := GetBankId(b.BankId)
+		allowed := false
+		for _, c := range gatewayBankChannels {
+			if c == bid.Channel {
+				allowed = true
+				break
+			}
+		}
+		if !allowed {
+			ve.add("bankId", RULE_BANK_ID, MSG_BANK_ID_NOT_ALLOWED, b.BankId, bid.Category)
+		} else if _, ok := GetBank(bid.BankCode); !ok {
+			//后缀正确 银行编码也要在 bankid 目录中
+			ve.add("bankId", RULE_BANK_ID, MSG_BANK_ID_UNKNOWN, b.BankId)
+		}
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+func init() {
+	registerApi(new(bestpay_gateway_pay))
+}
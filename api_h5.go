@@ -0,0 +1,141 @@
+package openbestpay
+
+import (
+	"fmt"
+)
+
+/**
+H5 支付
+1.服务端调用 H5 下单接口 https://webpaywg.bestpay.com.cn/order.action 创建订单
+2.用 H5 收银台 https://webpaywg.bestpay.com.cn/payWap.do 生成跳转链接或者自动提交的表单
+	api := GetApi(BESTPAY_URL_H5_CASHIER)
+	api.SetBizContent(Biz_bestpay_h5_cashier{...}, key)
+	form, err := api.HtmlForm()
+3.用户支付完成之后跳转回 pageUrl.支付结果以 backUrl 的异步通知或者交易查询为准
+*/
+
+/**
+H5 下单
+https://webpaywg.bestpay.com.cn/order.action
+*/
+type bestpay_h5_order struct {
+	BestpayApi
+}
+
+func (a *bestpay_h5_order) apiMethod() string {
+	return BESTPAY_URL_H5_ORDER
+}
+
+func (a *bestpay_h5_order) apiName() string {
+	return "H5下单"
+}
+
+type Biz_bestpay_h5_order struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，全局唯一 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //格式 yyyyMMddhhmmss
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额
+	ProductAmt    int    `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int    `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	BusiType      string `json:"busiType,omitempty"`                                         //默认填:0000001
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	LedgerDetail  string `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //分账明细 256
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_h5_order) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+//busiType 没有填的时候使用默认值
+func (b Biz_bestpay_h5_order) defaults() bizInterface {
+	if b.BusiType == "" {
+		b.BusiType = "0000001"
+	}
+	return b
+}
+
+func (b Biz_bestpay_h5_order) valid() error {
+	ve := validStruct(b)
+
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+type Resp_bestpay_h5_order struct {
+	MerchantId string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	OrderNo    string `json:"orderNo,omitempty"`         //商户订单号 30
+	OrderReqNo string `json:"orderReqNo,omitempty"`      //商户请求流水号 30
+	TransAmt   int    `json:"transAmt,omitempty,string"` //单位:分。
+	Sign       string `json:"sign,omitempty"`            //十六进制
+}
+
+/**
+H5 收银台
+https://webpaywg.bestpay.com.cn/payWap.do
+页面跳转.用 RedirectUrl 或者 HtmlForm 生成.不要调用 Run
+*/
+type bestpay_h5_cashier struct {
+	BestpayApi
+}
+
+func (a *bestpay_h5_cashier) apiMethod() string {
+	return BESTPAY_URL_H5_CASHIER
+}
+
+func (a *bestpay_h5_cashier) apiName() string {
+	return "H5收银台"
+}
+
+type Biz_bestpay_h5_cashier struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //与 H5 下单时相同 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //与 H5 下单时相同 30
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //与 H5 下单时相同
+	OrderAmt      int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。与 H5 下单时相同
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	PageUrl       string `json:"pageUrl,omitempty" bestpay:"required,max=255"`               //支付完成之后用户浏览器跳转的地址 255
+	BackUrl       string `json:"backUrl,omitempty" bestpay:"max=255"`                        //异步通知地址 255
+	ClientIp      string `json:"clientIp,omitempty" bestpay:"max=64"`                        //用户的 ip 64
+	Attach        string `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_h5_cashier) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_h5_cashier) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+func init() {
+	registerApi(new(bestpay_h5_order))
+	registerApi(new(bestpay_h5_cashier))
+}
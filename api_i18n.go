@@ -0,0 +1,329 @@
+package openbestpay
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+)
+
+/**
+多语言提示信息
+校验错误/网关错误/交易状态/BANKID 说明 统一从这里取.
+默认中文.可以通过 SetLang 切换为英文.也可以通过 RegisterMessages 补充或覆盖
+*/
+
+//支持的语言
+const (
+	LANG_ZH = "zh"
+	LANG_EN = "en"
+)
+
+//提示信息的 key
+const (
+	MSG_CAN_NOT_NIL         = "can_not_nil"
+	MSG_FORMAT_ERROR        = "format_error"
+	MSG_MAX_LEN             = "max_len"
+	MSG_EVEN_LEN            = "even_len"
+	MSG_MIN                 = "min"
+	MSG_ORDER_AMT_SUM       = "order_amt_sum"
+	MSG_GOODS_DETAIL_SUM    = "goods_detail_sum"
+	MSG_KEY_NIL             = "key_nil"
+	MSG_BANK_ID_NOT_ALLOWED = "bank_id_not_allowed"
+	MSG_BANK_ID_UNKNOWN     = "bank_id_unknown"
+	MSG_ONE_OF_REQUIRED     = "one_of_required"
+	MSG_LEDGER_SUBMCH_NIL   = "ledger_submch_nil"
+	MSG_LEDGER_AMT_ZERO     = "ledger_amt_zero"
+	MSG_LEDGER_NIL          = "ledger_nil"
+	MSG_LEDGER_MAX_NUM      = "ledger_max_num"
+	MSG_LEDGER_TOTAL_ZERO   = "ledger_total_zero"
+	MSG_LEDGER_MIN_AMT      = "ledger_min_amt"
+	MSG_LEDGER_TOTAL_EQUAL  = "ledger_total_equal"
+	MSG_LEDGER_FORMAT       = "ledger_format"
+	MSG_CIRCUIT_OPEN        = "circuit_open"
+	MSG_RATE_LIMITED        = "rate_limited"
+	MSG_ORDER_TRANSITION    = "order_transition"
+	MSG_ORDER_EVENT         = "order_event"
+	MSG_REFUND_NO_ORDER     = "refund_no_order"
+	MSG_REFUND_NOT_PAID     = "refund_not_paid"
+	MSG_REFUND_EXCEEDED     = "refund_exceeded"
+	MSG_SYSTEM_ERROR        = "system_error"
+	MSG_FIELD_NIL           = "field_nil"
+	MSG_FIELD_FORMAT        = "field_format"
+	MSG_STORE_NO_STALE      = "store_no_stale"
+	MSG_REFUND_DUPLICATED   = "refund_duplicated"
+	MSG_REFUND_NOT_RUN      = "refund_not_run"
+	MSG_REFUND_CANCELLED    = "refund_cancelled"
+	MSG_NOTIFY_SIGN         = "notify_sign"
+	MSG_NOTIFY_UNKNOWN      = "notify_unknown"
+	MSG_LANG_UNSUPPORTED    = "lang_unsupported"
+	MSG_ORDER_NOT_FOUND     = "order_not_found"
+	MSG_ORDER_EXISTS        = "order_exists"
+	MSG_ORDER_CONFLICT      = "order_conflict"
+
+	//交易状态 transStatus
+	MSG_TRANS_STATUS_A = "trans_status_" + TRANS_STATUS_PAYING
+	MSG_TRANS_STATUS_B = "trans_status_" + TRANS_STATUS_SUCCESS
+	MSG_TRANS_STATUS_C = "trans_status_" + TRANS_STATUS_FAIL
+
+	//BANKID 的类别和说明.key 为前缀 + 渠道类别 BANK_CHANNEL_*
+	MSG_BANK_CATEGORY_PREFIX  = "bank_category_"
+	MSG_BANK_DESC_PREFIX      = "bank_desc_"
+	MSG_BANK_CATEGORY_BALANCE = MSG_BANK_CATEGORY_PREFIX + BANK_CHANNEL_BALANCE
+	MSG_BANK_CATEGORY_QUICK   = MSG_BANK_CATEGORY_PREFIX + BANK_CHANNEL_QUICK
+	MSG_BANK_CATEGORY_B2B     = MSG_BANK_CATEGORY_PREFIX + BANK_CHANNEL_B2B
+	MSG_BANK_CATEGORY_B2C     = MSG_BANK_CATEGORY_PREFIX + BANK_CHANNEL_B2C
+	MSG_BANK_CATEGORY_NONE    = MSG_BANK_CATEGORY_PREFIX + BANK_CHANNEL_NONE
+	MSG_BANK_DESC_BALANCE     = MSG_BANK_DESC_PREFIX + BANK_CHANNEL_BALANCE
+	MSG_BANK_DESC_QUICK       = MSG_BANK_DESC_PREFIX + BANK_CHANNEL_QUICK
+	MSG_BANK_DESC_B2B         = MSG_BANK_DESC_PREFIX + BANK_CHANNEL_B2B
+	MSG_BANK_DESC_B2C         = MSG_BANK_DESC_PREFIX + BANK_CHANNEL_B2C
+	MSG_BANK_DESC_NONE        = MSG_BANK_DESC_PREFIX + BANK_CHANNEL_NONE
+
+	//资金类型.key 为前缀 + FUND_TYPE_*
+	MSG_FUND_TYPE_PREFIX = "fund_type_"
+
+	MSG_GATEWAY_ERROR_PREFIX   = "gateway_"
+	MSG_GATEWAY_UNKNOWN_ERROR  = "gateway_unknown"
+	MSG_GATEWAY_EMPTY_RESPONSE = "gateway_empty_response"
+	MSG_GATEWAY_INVALID_RESULT = "gateway_invalid_result"
+)
+
+var messages = map[string]map[string]string{
+	LANG_ZH: {
+		MSG_CAN_NOT_NIL:         CAN_NOT_NIL,
+		MSG_FORMAT_ERROR:        FORAMT_ERROR,
+		MSG_MAX_LEN:             "长度不能超过 %d",
+		MSG_EVEN_LEN:            "长度必须为偶数",
+		MSG_MIN:                 "不能小于 %d",
+		MSG_ORDER_AMT_SUM:       "订单金额必须等于产品金额与附加金额之和",
+		MSG_GOODS_DETAIL_SUM:    "productAmt(%d) 与商品详情合计金额(%d)不一致",
+		MSG_KEY_NIL:             "key 不能为空",
+		MSG_BANK_ID_NOT_ALLOWED: "%s 属于 %s.不能用于网关支付",
+		MSG_BANK_ID_UNKNOWN:     "%s 的银行编码不在 bankid 目录中",
+		MSG_ONE_OF_REQUIRED:     "与 %s 不能同时为空",
+		MSG_LEDGER_SUBMCH_NIL:   "分账子商户号不能为空",
+		MSG_LEDGER_AMT_ZERO:     "分账金额不能为 0",
+		MSG_LEDGER_NIL:          "分账信息不能为空",
+		MSG_LEDGER_MAX_NUM:      "分账商户不能超过 10 个",
+		MSG_LEDGER_TOTAL_ZERO:   "分账总金额不能为 0",
+		MSG_LEDGER_MIN_AMT:      "单个商户分账金额最小为 1 分",
+		MSG_LEDGER_TOTAL_EQUAL:  "分账总金额与各商户分账金额之和不一致",
+		MSG_LEDGER_FORMAT:       "分账明细格式错误 %s",
+		MSG_CIRCUIT_OPEN:        "网关熔断中 %s",
+		MSG_RATE_LIMITED:        "请求过于频繁",
+		MSG_ORDER_TRANSITION:    "订单状态不能变化 %s: %s -> %s",
+		MSG_ORDER_EVENT:         "未知的订单事件 %s",
+		MSG_REFUND_NO_ORDER:     "找不到原订单 %s",
+		MSG_REFUND_NOT_PAID:     "订单 %s 状态为 %s 不能退款",
+		MSG_REFUND_EXCEEDED:     "退款金额 %d 超过可退金额 %d",
+		MSG_SYSTEM_ERROR:        "系统错误",
+		MSG_FIELD_NIL:           "%s " + CAN_NOT_NIL,
+		MSG_FIELD_FORMAT:        "%s " + FORAMT_ERROR + ": %s",
+		MSG_STORE_NO_STALE:      "订单存储没有实现 StaleOrderLister",
+		MSG_REFUND_DUPLICATED:   "同一批中 refundReqNo 重复",
+		MSG_REFUND_NOT_RUN:      "进度保存失败.没有执行",
+		MSG_REFUND_CANCELLED:    "已取消.没有执行",
+		MSG_NOTIFY_SIGN:         "异步通知签名错误 %s",
+		MSG_NOTIFY_UNKNOWN:      "异步通知返回码 %s 不能确定支付结果.请用交易查询确认",
+		MSG_LANG_UNSUPPORTED:    "不支持的语言 %s",
+		MSG_ORDER_NOT_FOUND:     "订单不存在",
+		MSG_ORDER_EXISTS:        "订单已经存在",
+		MSG_ORDER_CONFLICT:      "订单版本冲突",
+
+		MSG_TRANS_STATUS_A: "支付中",
+		MSG_TRANS_STATUS_B: "支付成功",
+		MSG_TRANS_STATUS_C: "支付失败",
+
+		MSG_BANK_CATEGORY_BALANCE: "个账余额",
+		MSG_BANK_CATEGORY_QUICK:   "快捷支付",
+		MSG_BANK_CATEGORY_B2B:     "企业网银",
+		MSG_BANK_CATEGORY_B2C:     "个人网银",
+		MSG_BANK_CATEGORY_NONE:    "无",
+		MSG_BANK_DESC_BALANCE:     "个账余额类型",
+		MSG_BANK_DESC_QUICK:       "快捷支付类型",
+		MSG_BANK_DESC_B2B:         "对公业务类型",
+		MSG_BANK_DESC_B2C:         "对私业务类型",
+		MSG_BANK_DESC_NONE:        "无此信息",
+
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_BALANCE:  "余额",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_QUICK:    "快捷支付",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_CARD:     "卡支付",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_VOUCHER:  "代金券",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_DISCOUNT: "立减",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_UNKNOWN:  "未知",
+
+		MSG_GATEWAY_UNKNOWN_ERROR:  "网关返回错误 %s",
+		MSG_GATEWAY_EMPTY_RESPONSE: "网关没有返回数据",
+		MSG_GATEWAY_INVALID_RESULT: "网关返回的数据无法解析 %s",
+	},
+	LANG_EN: {
+		MSG_CAN_NOT_NIL:         "can not be empty",
+		MSG_FORMAT_ERROR:        "invalid format",
+		MSG_MAX_LEN:             "length can not exceed %d",
+		MSG_EVEN_LEN:            "length must be even",
+		MSG_MIN:                 "can not be less than %d",
+		MSG_ORDER_AMT_SUM:       "orderAmt = productAmt + attachAmt",
+		MSG_GOODS_DETAIL_SUM:    "productAmt(%d) != sum(goodsDetail price * quantity)(%d)",
+		MSG_KEY_NIL:             "key is nil",
+		MSG_BANK_ID_NOT_ALLOWED: "%s is %s and can not be used for gateway payment",
+		MSG_BANK_ID_UNKNOWN:     "bank code of %s is not in the bankid catalog",
+		MSG_ONE_OF_REQUIRED:     "and %s can not both be empty",
+		MSG_LEDGER_SUBMCH_NIL:   "subMchId can not be nil",
+		MSG_LEDGER_AMT_ZERO:     "amount can not be zero",
+		MSG_LEDGER_NIL:          "legder is nil",
+		MSG_LEDGER_MAX_NUM:      "legder max number is ten",
+		MSG_LEDGER_TOTAL_ZERO:   "total amount is zero",
+		MSG_LEDGER_MIN_AMT:      "per legder min amount is 1",
+		MSG_LEDGER_TOTAL_EQUAL:  "total amount not equal sum(legder amount)",
+		MSG_LEDGER_FORMAT:       "invalid ledger detail %s",
+		MSG_CIRCUIT_OPEN:        "circuit open %s",
+		MSG_RATE_LIMITED:        "rate limited",
+		MSG_ORDER_TRANSITION:    "invalid order transition %s: %s -> %s",
+		MSG_ORDER_EVENT:         "unknown order event %s",
+		MSG_REFUND_NO_ORDER:     "original order %s not found",
+		MSG_REFUND_NOT_PAID:     "order %s in state %s can not be refunded",
+		MSG_REFUND_EXCEEDED:     "refund amount %d exceeds refundable amount %d",
+		MSG_SYSTEM_ERROR:        "system error",
+		MSG_FIELD_NIL:           "%s can not be empty",
+		MSG_FIELD_FORMAT:        "invalid %s: %s",
+		MSG_STORE_NO_STALE:      "order store does not implement StaleOrderLister",
+		MSG_REFUND_DUPLICATED:   "refundReqNo duplicated in batch",
+		MSG_REFUND_NOT_RUN:      "not executed: saving progress failed",
+		MSG_REFUND_CANCELLED:    "not executed: cancelled",
+		MSG_NOTIFY_SIGN:         "invalid notify sign %s",
+		MSG_NOTIFY_UNKNOWN:      "notify code %s does not decide the payment result, query the order",
+		MSG_LANG_UNSUPPORTED:    "unsupported lang %s",
+		MSG_ORDER_NOT_FOUND:     "order not found",
+		MSG_ORDER_EXISTS:        "order already exists",
+		MSG_ORDER_CONFLICT:      "order version conflict",
+
+		MSG_TRANS_STATUS_A: "paying",
+		MSG_TRANS_STATUS_B: "paid",
+		MSG_TRANS_STATUS_C: "failed",
+
+		MSG_BANK_CATEGORY_BALANCE: "account balance",
+		MSG_BANK_CATEGORY_QUICK:   "quick pay",
+		MSG_BANK_CATEGORY_B2B:     "corporate online banking",
+		MSG_BANK_CATEGORY_B2C:     "personal online banking",
+		MSG_BANK_CATEGORY_NONE:    "none",
+		MSG_BANK_DESC_BALANCE:     "account balance",
+		MSG_BANK_DESC_QUICK:       "quick pay",
+		MSG_BANK_DESC_B2B:         "corporate business",
+		MSG_BANK_DESC_B2C:         "personal business",
+		MSG_BANK_DESC_NONE:        "unknown",
+
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_BALANCE:  "balance",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_QUICK:    "quick pay",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_CARD:     "card",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_VOUCHER:  "voucher",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_DISCOUNT: "instant discount",
+		MSG_FUND_TYPE_PREFIX + FUND_TYPE_UNKNOWN:  "unknown",
+
+		MSG_GATEWAY_UNKNOWN_ERROR:  "gateway error %s",
+		MSG_GATEWAY_EMPTY_RESPONSE: "gateway returned nothing",
+		MSG_GATEWAY_INVALID_RESULT: "gateway returned an invalid response %s",
+	},
+}
+
+var (
+	lang      = LANG_ZH
+	langMutex sync.RWMutex
+)
+
+//设置默认语言
+func SetLang(l string) error {
+	langMutex.Lock()
+	_, ok := messages[l]
+	if ok {
+		lang = l
+	}
+	langMutex.Unlock()
+
+	//msgError 需要读锁.解锁之后再生成
+	if !ok {
+		return msgError(MSG_LANG_UNSUPPORTED, l)
+	}
+	return nil
+}
+
+func GetLang() string {
+	langMutex.RLock()
+	defer langMutex.RUnlock()
+	return lang
+}
+
+//补充或者覆盖某个语言的提示信息.
+//网关错误码可以用 MSG_GATEWAY_ERROR_PREFIX + errorCode 作为 key 注册
+func RegisterMessages(l string, m map[string]string) {
+	langMutex.Lock()
+	defer langMutex.Unlock()
+
+	bundle, ok := messages[l]
+	if !ok {
+		bundle = map[string]string{}
+		messages[l] = bundle
+	}
+	for k, v := range m {
+		bundle[k] = v
+	}
+}
+
+//按指定语言取提示信息.没有的话依次取中文.最后返回 key 本身
+func Message(l, key string, args ...interface{}) string {
+	langMutex.RLock()
+	format, ok := messages[l][key]
+	if !ok {
+		format, ok = messages[LANG_ZH][key]
+	}
+	langMutex.RUnlock()
+
+	if !ok {
+		format = key
+	}
+
+	if len(args) > 0 {
+		return fmt.Sprintf(format, args...)
+	}
+	return format
+}
+
+//按默认语言取提示信息
+func msg(key string, args ...interface{}) string {
+	return Message(GetLang(), key, args...)
+}
+
+//按默认语言生成一个 error
+func msgError(key string, args ...interface{}) error {
+	return errors.New(msg(key, args...))
+}
+
+//固定 key 的 error.Error() 时才按默认语言取提示信息.可以直接用 == 比较
+type msgKeyError string
+
+func (e msgKeyError) Error() string {
+	return msg(string(e))
+}
+
+//交易状态 A B C 的说明
+func TransStatusDesc(l, status string) string {
+	return Message(l, "trans_status_"+status)
+}
+
+//网关错误的说明.有注册对应的错误码就用注册的.否则用网关返回的 errorMsg
+func (r Response) Message(l string) string {
+	if r.ErrorCode == "" {
+		return r.ErrorMsg
+	}
+
+	langMutex.RLock()
+	format, ok := messages[l][MSG_GATEWAY_ERROR_PREFIX+r.ErrorCode]
+	langMutex.RUnlock()
+	if ok {
+		return format
+	}
+
+	if r.ErrorMsg != "" {
+		return r.ErrorMsg
+	}
+	return Message(l, MSG_GATEWAY_UNKNOWN_ERROR, r.ErrorCode)
+}
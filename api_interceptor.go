@@ -0,0 +1,86 @@
+package openbestpay
+
+import (
+	"context"
+	"sync"
+)
+
+/**
+拦截器
+在每个接口的执行前后插入自定义的逻辑.如链路追踪 审计 日志.不需要修改 sdk
+	Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			start := time.Now()
+			err := next(inv)
+			logs.Debug(inv.ApiName, time.Since(start), inv.Raw)
+			return err
+		}
+	})
+先注册的在外层.最内层是限流 熔断和实际的网络请求
+拦截器可以不调用 next 直接返回.这时请求不会发送到网关
+*/
+
+//一次接口调用
+type Invocation struct {
+	Ctx     context.Context        //见 BestpayApi.WithContext.拦截器可以替换.如开始一个 span
+	ApiName string                 //接口名称
+	Method  string                 //接口地址
+	Biz     interface{}            //业务参数 Biz_bestpay_*
+	Params  map[string]interface{} //签名之后实际发送的参数.包括 mac
+	Raw     string                 //网关返回的原始数据.next 返回之后才有
+
+	sent bool //请求是否发送到网关.拦截器直接返回 或者被熔断 限流的为 false
+}
+
+//执行一次接口调用
+type Invoker func(inv *Invocation) error
+
+type Interceptor func(next Invoker) Invoker
+
+var (
+	interceptors      []Interceptor
+	interceptorsMutex sync.RWMutex
+)
+
+//注册全局拦截器
+func Use(i ...Interceptor) {
+	interceptorsMutex.Lock()
+	defer interceptorsMutex.Unlock()
+
+	interceptors = append(interceptors, i...)
+}
+
+//清除所有拦截器
+func ResetInterceptors() {
+	interceptorsMutex.Lock()
+	defer interceptorsMutex.Unlock()
+
+	interceptors = nil
+}
+
+//把拦截器包装在 invoker 外面
+func chainInterceptors(invoker Invoker) Invoker {
+	interceptorsMutex.RLock()
+	defer interceptorsMutex.RUnlock()
+
+	for i := len(interceptors) - 1; i >= 0; i-- {
+		invoker = interceptors[i](invoker)
+	}
+	return invoker
+}
+
+//最内层.经过限流和熔断之后发送请求
+func (b *BestpayApi) invoke(inv *Invocation) error {
+	raw, err := b.guarded(inv.Ctx, inv.Params)
+	if _, ok := err.(*GuardError); !ok {
+		inv.sent = true
+	}
+	inv.Raw = raw
+	return err
+}
+
+//设置之后 Run 时传给拦截器.用于链路追踪等.也会用于网络请求.ctx 结束时请求立即返回
+func (b *BestpayApi) WithContext(ctx context.Context) *BestpayApi {
+	b.ctx = ctx
+	return b
+}
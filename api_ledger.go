@@ -0,0 +1,179 @@
+package openbestpay
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+/**
+分账结果查询
+https://webpaywg.bestpay.com.cn/ledger/queryLedgerDetail
+按订单查询网关实际的分账结算情况.每个子商户一条
+用 CompareLedger 与下单时 SetLedgers 传入的 Ledger 对比
+*/
+type bestpay_ledger_query struct {
+	BestpayApi
+}
+
+func (a *bestpay_ledger_query) apiMethod() string {
+	return BESTPAY_URL_LEDGER_QUERY
+}
+
+func (a *bestpay_ledger_query) apiName() string {
+	return "分账结果查询"
+}
+
+type Biz_bestpay_ledger_query struct {
+	MerchantId string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	OrderNo    string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //下单时的订单号 30
+	OrderReqNo string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //下单时的请求流水号 30
+	OrderDate  string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //下单时的订单日期 yyyyMMddhhmmss
+	Mac        string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
+
+//mac 校验域.与交易查询相同
+//返回一个待 mac 的数据
+func (b Biz_bestpay_ledger_query) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+
+	return tobe_mac
+}
+
+func (b Biz_bestpay_ledger_query) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
+
+//一个子商户的分账结算结果
+type LedgerSettleItem struct {
+	SubMerchantId string `json:"subMerchantId,omitempty"`    //分账子商户号
+	LedgerAmt     int    `json:"ledgerAmt,omitempty,string"` //单位:分。实际分账金额
+	SettleStatus  string `json:"settleStatus,omitempty"`     //A:待结算 B:已结算 C:结算失败 见 SETTLE_STATUS_*
+	SettleDate    string `json:"settleDate,omitempty"`       //结算日期 yyyyMMdd.未结算的为空
+}
+
+type Resp_bestpay_ledger_query struct {
+	MerchantId   string             `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	OrderNo      string             `json:"orderNo,omitempty"`         //商户订单号 30
+	OrderReqNo   string             `json:"orderReqNo,omitempty"`      //商户请求流水号 30
+	TransAmt     int                `json:"transAmt,omitempty,string"` //单位:分。
+	LedgerDetail []LedgerSettleItem `json:"ledgerDetail,omitempty"`    //各子商户的分账结果
+	Sign         string             `json:"sign,omitempty"`            //十六进制
+}
+
+//与下单时的分账信息对比
+func (r Resp_bestpay_ledger_query) Compare(sent Ledger) []LedgerDiff {
+	return CompareLedger(sent, r.LedgerDetail)
+}
+
+//解析 SetLedgers 生成的分账明细 subMchId:amount|subMchId:amount
+func ParseLedger(s string) (Ledger, error) {
+	l := Ledger{}
+	for _, part := range strings.Split(s, "|") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		i := strings.LastIndex(part, ":")
+		if i < 0 {
+			return nil, msgError(MSG_LEDGER_FORMAT, part)
+		}
+		amount, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+		if err != nil || amount <= 0 {
+			return nil, msgError(MSG_LEDGER_FORMAT, part)
+		}
+		if err := l.Set(strings.TrimSpace(part[:i]), amount); err != nil {
+			return nil, err
+		}
+	}
+
+	if len(l) == 0 {
+		return nil, msgError(MSG_LEDGER_NIL)
+	}
+	return l, nil
+}
+
+//分账对比的差异类型
+const (
+	LEDGER_DIFF_MISSING     = "missing"     //下单时有.网关没有返回
+	LEDGER_DIFF_UNEXPECTED  = "unexpected"  //网关返回了.下单时没有
+	LEDGER_DIFF_AMOUNT      = "amount"      //金额不一致
+	LEDGER_DIFF_UNSETTLED   = "unsettled"   //金额一致.还没有结算
+	LEDGER_DIFF_SETTLE_FAIL = "settle_fail" //金额一致.结算失败
+)
+
+//一个子商户的分账差异
+type LedgerDiff struct {
+	SubMerchantId string
+	Type          string //LEDGER_DIFF_*
+	Expected      int    //下单时的分账金额 单位:分
+	Actual        int    //网关实际的分账金额 单位:分
+	SettleStatus  string //网关返回的结算状态
+}
+
+/**
+对比下单时的分账信息与网关返回的分账结果
+返回有差异的子商户.按子商户号排序.全部一致并且已经结算的返回空
+*/
+func CompareLedger(sent Ledger, settled []LedgerSettleItem) []LedgerDiff {
+	diffs := []LedgerDiff{}
+
+	actual := map[string]LedgerSettleItem{}
+	for _, item := range settled {
+		//同一个子商户出现多次的.金额累加
+		if v, ok := actual[item.SubMerchantId]; ok {
+			item.LedgerAmt += v.LedgerAmt
+		}
+		actual[item.SubMerchantId] = item
+	}
+
+	for subMchId, amount := range sent {
+		item, ok := actual[subMchId]
+		d := LedgerDiff{
+			SubMerchantId: subMchId,
+			Expected:      amount,
+			Actual:        item.LedgerAmt,
+			SettleStatus:  item.SettleStatus,
+		}
+
+		switch {
+		case !ok:
+			d.Type = LEDGER_DIFF_MISSING
+		case item.LedgerAmt != amount:
+			d.Type = LEDGER_DIFF_AMOUNT
+		case item.SettleStatus == SETTLE_STATUS_FAIL:
+			d.Type = LEDGER_DIFF_SETTLE_FAIL
+		case item.SettleStatus != SETTLE_STATUS_DONE:
+			d.Type = LEDGER_DIFF_UNSETTLED
+		default:
+			continue
+		}
+		diffs = append(diffs, d)
+	}
+
+	for subMchId, item := range actual {
+		if _, ok := sent[subMchId]; ok {
+			continue
+		}
+		diffs = append(diffs, LedgerDiff{
+			SubMerchantId: subMchId,
+			Type:          LEDGER_DIFF_UNEXPECTED,
+			Actual:        item.LedgerAmt,
+			SettleStatus:  item.SettleStatus,
+		})
+	}
+
+	sort.Slice(diffs, func(i, j int) bool {
+		return diffs[i].SubMerchantId < diffs[j].SubMerchantId
+	})
+	return diffs
+}
+
+func init() {
+	registerApi(new(bestpay_ledger_query))
+}
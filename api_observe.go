@@ -0,0 +1,84 @@
+package openbestpay
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+/**
+监控埋点
+sdk 本身不依赖任何监控组件.通过 Observer 接入:
+	import "github.com/liteck/openbestpay/otelbestpay"  //OpenTelemetry 链路追踪
+	import "github.com/liteck/openbestpay/prombestpay"  //Prometheus 指标
+	Use(Observe(otelbestpay.New(nil)))
+不需要的不 import 即可.也可以自己实现 Observer
+*/
+
+//一次调用的观测数据
+type Observation struct {
+	ApiName     string        //接口名称
+	Method      string        //接口地址
+	MerchantId  string        //商户号
+	OrderNo     string        //订单号.没有的为空
+	TransStatus string        //网关返回的交易状态.没有的为空
+	Success     bool          //网关返回 success=true
+	ErrorCode   string        //网关返回的错误码
+	Err         error         //网络错误 熔断 限流等.网关的业务错误见 ErrorCode
+	Duration    time.Duration //耗时
+}
+
+type Observer interface {
+	//调用开始时执行.返回的函数在调用结束时执行
+	//可以替换 inv.Ctx.如开始一个 span
+	Begin(inv *Invocation) func(o Observation)
+}
+
+//把 Observer 包装成拦截器
+func Observe(o Observer) Interceptor {
+	return func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			if inv.Ctx == nil {
+				inv.Ctx = context.Background()
+			}
+
+			start := time.Now()
+			end := o.Begin(inv)
+			err := next(inv)
+
+			ob := Observation{
+				ApiName:    inv.ApiName,
+				Method:     inv.Method,
+				MerchantId: bizField(inv.Biz, "MerchantId"),
+				OrderNo:    bizField(inv.Biz, "OrderNo"),
+				Err:        err,
+				Duration:   time.Since(start),
+			}
+			if ob.OrderNo == "" {
+				ob.OrderNo = bizField(inv.Biz, "OldOrderNo")
+			}
+			if err == nil {
+				ob.Success, ob.ErrorCode, ob.TransStatus = parseObservation(inv.Raw)
+			}
+			end(ob)
+
+			return err
+		}
+	}
+}
+
+//从原始数据中取出 success errorCode transStatus
+func parseObservation(raw string) (bool, string, string) {
+	var tmp struct {
+		Success   interface{} `json:"success"`
+		ErrorCode string      `json:"errorCode"`
+		Result    struct {
+			TransStatus string `json:"transStatus"`
+		} `json:"result"`
+	}
+	if err := json.Unmarshal([]byte(raw), &tmp); err != nil {
+		return false, "", ""
+	}
+	return fmt.Sprintf("%v", tmp.Success) == "true", tmp.ErrorCode, tmp.Result.TransStatus
+}
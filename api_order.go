@@ -0,0 +1,474 @@
+package openbestpay
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/liteck/tools"
+)
+
+/**
+订单状态机
+	created → paying → paid/failed → partially_refunded/refunded/reversed
+	created/paying → closed
+状态只能按上面的方向变化.由接口的返回或者异步通知驱动:
+	m := NewOrderMachine(store)
+	m.Create(Order{MerchantId: ..., OrderNo: ..., OrderReqNo: ..., OrderAmt: 100})
+	api.Run() ; api.Response(&resp)
+	m.Apply(merchantId, orderNo, EventFromPlaceOrder(resp))
+重复的事件(如多次收到同一个支付成功的通知)不会报错.也不会重复记账
+订单的存储见 OrderStore
+*/
+
+//订单状态
+const (
+	ORDER_CREATED            = "created"            //已创建.还没有发送到网关
+	ORDER_PAYING             = "paying"             //支付中 transStatus=A
+	ORDER_PAID               = "paid"               //支付成功 transStatus=B
+	ORDER_FAILED             = "failed"             //支付失败 transStatus=C
+	ORDER_PARTIALLY_REFUNDED = "partially_refunded" //部分退款
+	ORDER_REFUNDED           = "refunded"           //全额退款
+	ORDER_REVERSED           = "reversed"           //已撤单
+	ORDER_CLOSED             = "closed"             //未支付.已关闭
+)
+
+//每个状态可以变化到的状态
+var orderTransitions = map[string][]string{
+	ORDER_CREATED:            {ORDER_PAYING, ORDER_PAID, ORDER_FAILED, ORDER_REVERSED, ORDER_CLOSED},
+	ORDER_PAYING:             {ORDER_PAID, ORDER_FAILED, ORDER_REVERSED, ORDER_CLOSED},
+	ORDER_PAID:               {ORDER_PARTIALLY_REFUNDED, ORDER_REFUNDED, ORDER_REVERSED},
+	ORDER_PARTIALLY_REFUNDED: {ORDER_PARTIALLY_REFUNDED, ORDER_REFUNDED},
+}
+
+//from 是否可以变化到 to
+func CanTransit(from, to string) bool {
+	for _, s := range orderTransitions[from] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+//是否是最终状态.最终状态不会再变化
+func IsFinalOrderState(state string) bool {
+	return len(orderTransitions[state]) == 0
+}
+
+//一笔退款
+type OrderRefund struct {
+	RefundReqNo string    `json:"refundReqNo"`
+	Amount      int       `json:"amount"` //单位:分
+	Time        time.Time `json:"time"`
+}
+
+type Order struct {
+	MerchantId  string        `json:"merchantId"`
+	OrderNo     string        `json:"orderNo"`
+	OrderReqNo  string        `json:"orderReqNo"`
+	OrderDate   string        `json:"orderDate"`             //yyyyMMddhhmmss
+	OrderAmt    int           `json:"orderAmt"`              //单位:分。下单金额
+	TransAmt    int           `json:"transAmt"`              //单位:分。网关返回的交易金额
+	Coupon      int           `json:"coupon"`                //单位:分。优惠金额
+	OurTransNo  string        `json:"ourTransNo,omitempty"`  //翼支付的内部流水号
+	TransStatus string        `json:"transStatus,omitempty"` //网关返回的交易状态 A B C
+	State       string        `json:"state"`                 //ORDER_*
+	Refunds     []OrderRefund `json:"refunds,omitempty"`     //已经成功的退款
+	Version     int           `json:"version"`               //每次保存加 1.用于乐观锁
+	CreatedAt   time.Time     `json:"createdAt"`
+	UpdatedAt   time.Time     `json:"updatedAt"`
+}
+
+//已经退款的金额
+func (o Order) RefundedAmt() int {
+	total := 0
+	for _, r := range o.Refunds {
+		total += r.Amount
+	}
+	return total
+}
+
+//可以退款的金额 = 交易金额 - 优惠 - 已经退款
+func (o Order) RefundableAmt() int {
+	amt := o.TransAmt
+	if amt == 0 {
+		amt = o.OrderAmt
+	}
+	if amt -= o.Coupon + o.RefundedAmt(); amt < 0 {
+		return 0
+	}
+	return amt
+}
+
+func (o Order) refunded(refundReqNo string) bool {
+	for _, r := range o.Refunds {
+		if r.RefundReqNo == refundReqNo {
+			return true
+		}
+	}
+	return false
+}
+
+//事件类型
+const (
+	ORDER_EVENT_PAY     = "pay"     //下单 查询 异步通知.按 transStatus 变化
+	ORDER_EVENT_REFUND  = "refund"  //退款成功
+	ORDER_EVENT_REVERSE = "reverse" //撤单成功
+	ORDER_EVENT_CLOSE   = "close"   //关闭成功
+)
+
+//驱动状态变化的事件
+type OrderEvent struct {
+	Type        string //ORDER_EVENT_*
+	TransStatus string //ORDER_EVENT_PAY 时有效
+	TransAmt    int    //支付时为交易金额.退款时为退款金额
+	Coupon      int
+	OurTransNo  string
+	RefundReqNo string //ORDER_EVENT_REFUND 时有效
+}
+
+func EventFromPlaceOrder(r Resp_bestpay_barcode_placeorder) OrderEvent {
+	return OrderEvent{
+		Type:        ORDER_EVENT_PAY,
+		TransStatus: r.TransStatus,
+		TransAmt:    r.TransAmt,
+		Coupon:      r.Coupon,
+		OurTransNo:  r.OurTransNo,
+	}
+}
+
+func EventFromQueryOrder(r Resp_bestpay_queryorder) OrderEvent {
+	return OrderEvent{
+		Type:        ORDER_EVENT_PAY,
+		TransStatus: r.TransStatus,
+		TransAmt:    r.TransAmt,
+		Coupon:      r.Coupon,
+		OurTransNo:  r.OurTransNo,
+	}
+}
+
+func EventFromRefund(r Resp_bestpay_commonrefund) OrderEvent {
+	return OrderEvent{
+		Type:        ORDER_EVENT_REFUND,
+		TransAmt:    r.TransAmt,
+		RefundReqNo: r.RefundReqNo,
+	}
+}
+
+func EventFromReverse(r Resp_bestpay_reverse) OrderEvent {
+	return OrderEvent{Type: ORDER_EVENT_REVERSE}
+}
+
+func EventFromCloseOrder(r Resp_bestpay_closeorder) OrderEvent {
+	return OrderEvent{Type: ORDER_EVENT_CLOSE}
+}
+
+/**
+支付结果异步通知
+网关 POST 到 backUrl 的参数.用 ParseNotify 验签并解析
+SIGN = MD5(UPTRANSEQ=..&TRANDATE=..&RETNCODE=..&RETNINFO=..&ORDERREQTRANSEQ=..&ORDERSEQ=..&ORDERAMOUNT=..
+	&PRODUCTAMOUNT=..&ATTACHAMOUNT=..&CURTYPE=..&ENCODETYPE=..&ATTACH=..&KEY=商户秘钥) 大写
+*/
+type Notify_bestpay_pay struct {
+	UpTranSeq       string //翼支付交易流水号
+	TranDate        string //交易日期 yyyyMMdd
+	RetnCode        string //NOTIFY_RETN_SUCCESS 表示成功.失败的返回码见 SetNotifyFailCodes
+	RetnInfo        string //返回信息
+	OrderReqTranSeq string //订单请求流水号
+	OrderSeq        string //订单号
+	OrderAmount     int    //单位:分.通知中的 ORDERAMOUNT 单位为元.如 0.01
+	Sign            string
+}
+
+//参与签名的字段.按顺序
+var notifySignFields = []string{
+	"UPTRANSEQ", "TRANDATE", "RETNCODE", "RETNINFO", "ORDERREQTRANSEQ", "ORDERSEQ",
+	"ORDERAMOUNT", "PRODUCTAMOUNT", "ATTACHAMOUNT", "CURTYPE", "ENCODETYPE", "ATTACH",
+}
+
+//异步通知的签名
+func notifySign(v url.Values, key string) string {
+	tobe_mac := ""
+	for _, f := range notifySignFields {
+		tobe_mac += f + "=" + v.Get(f) + "&"
+	}
+	tobe_mac += "KEY=" + key
+	return strings.ToUpper(tools.MD5(tobe_mac))
+}
+
+//验签并解析异步通知.key 为商户秘钥.签名不对的返回错误
+func ParseNotify(v url.Values, key string) (Notify_bestpay_pay, error) {
+	n := Notify_bestpay_pay{
+		UpTranSeq:       v.Get("UPTRANSEQ"),
+		TranDate:        v.Get("TRANDATE"),
+		RetnCode:        v.Get("RETNCODE"),
+		RetnInfo:        v.Get("RETNINFO"),
+		OrderReqTranSeq: v.Get("ORDERREQTRANSEQ"),
+		OrderSeq:        v.Get("ORDERSEQ"),
+		Sign:            v.Get("SIGN"),
+	}
+	if key == "" {
+		return n, msgError(MSG_KEY_NIL)
+	}
+	if n.Sign == "" || !strings.EqualFold(n.Sign, notifySign(v, key)) {
+		return n, msgError(MSG_NOTIFY_SIGN, n.OrderSeq)
+	}
+
+	if n.OrderSeq == "" {
+		return n, msgError(MSG_FIELD_NIL, "ORDERSEQ")
+	}
+
+	if s := v.Get("ORDERAMOUNT"); s != "" {
+		amt, err := yuanToFen(s)
+		if err != nil {
+			return n, msgError(MSG_FIELD_FORMAT, "ORDERAMOUNT", s)
+		}
+		n.OrderAmount = amt
+	}
+	return n, nil
+}
+
+//元转为分.如 0.01 -> 1.最多两位小数.不能为负数
+func yuanToFen(s string) (int, error) {
+	yuan, cent, dot := s, "", false
+	if i := strings.Index(s, "."); i >= 0 {
+		yuan, cent, dot = s[:i], s[i+1:], true
+	}
+	if yuan == "" || (dot && cent == "") || len(cent) > 2 || strings.Trim(yuan+cent, "0123456789") != "" {
+		return 0, msgError(MSG_FIELD_FORMAT, "amount", s)
+	}
+	for len(cent) < 2 {
+		cent += "0"
+	}
+	y, err := strconv.Atoi(yuan)
+	if err != nil {
+		return 0, err
+	}
+	c, _ := strconv.Atoi(cent)
+	return y*100 + c, nil
+}
+
+//异步通知支付成功的返回码
+const NOTIFY_RETN_SUCCESS = "0000"
+
+var (
+	notifyFailCodes      = map[string]bool{}
+	notifyFailCodesMutex sync.RWMutex
+)
+
+/**
+设置表示支付失败的返回码.默认为空
+文档只说明了 0000 表示成功.其它返回码不一定是最终失败(如处理中 系统繁忙)
+只有设置过的返回码才会把订单变为失败.其它的 EventFromNotify 返回错误.需要用交易查询确认
+*/
+func SetNotifyFailCodes(codes ...string) {
+	m := map[string]bool{}
+	for _, c := range codes {
+		m[c] = true
+	}
+
+	notifyFailCodesMutex.Lock()
+	notifyFailCodes = m
+	notifyFailCodesMutex.Unlock()
+}
+
+func isNotifyFailCode(code string) bool {
+	notifyFailCodesMutex.RLock()
+	defer notifyFailCodesMutex.RUnlock()
+	return notifyFailCodes[code]
+}
+
+//通知对应的事件.不能确定结果的返回码返回错误.见 SetNotifyFailCodes
+func EventFromNotify(n Notify_bestpay_pay) (OrderEvent, error) {
+	e := OrderEvent{
+		Type:       ORDER_EVENT_PAY,
+		TransAmt:   n.OrderAmount,
+		OurTransNo: n.UpTranSeq,
+	}
+	switch {
+	case n.RetnCode == NOTIFY_RETN_SUCCESS:
+		e.TransStatus = TRANS_STATUS_SUCCESS
+	case isNotifyFailCode(n.RetnCode):
+		e.TransStatus = TRANS_STATUS_FAIL
+	default:
+		return e, msgError(MSG_NOTIFY_UNKNOWN, n.RetnCode)
+	}
+	return e, nil
+}
+
+//不允许的状态变化
+type TransitionError struct {
+	From  string
+	To    string
+	Event string
+}
+
+func (e *TransitionError) Error() string {
+	return msg(MSG_ORDER_TRANSITION, e.Event, e.From, e.To)
+}
+
+//事件对应的下一个状态.返回 false 表示事件重复.订单不需要变化
+func (o *Order) apply(e OrderEvent, now time.Time) (bool, error) {
+	to := ""
+	switch e.Type {
+	case ORDER_EVENT_PAY:
+		switch e.TransStatus {
+		case TRANS_STATUS_PAYING:
+			to = ORDER_PAYING
+		case TRANS_STATUS_SUCCESS:
+			to = ORDER_PAID
+		case TRANS_STATUS_FAIL:
+			to = ORDER_FAILED
+		default:
+			return false, msgError(MSG_ORDER_EVENT, e.Type+":"+e.TransStatus)
+		}
+	case ORDER_EVENT_REFUND:
+		if e.RefundReqNo == "" {
+			return false, msgError(MSG_FIELD_NIL, "refundReqNo")
+		}
+		if o.refunded(e.RefundReqNo) {
+			return false, nil
+		}
+		refundable := o.RefundableAmt()
+		if e.TransAmt > refundable {
+			return false, msgError(MSG_REFUND_EXCEEDED, e.TransAmt, refundable)
+		}
+		to = ORDER_PARTIALLY_REFUNDED
+		if e.TransAmt == refundable {
+			to = ORDER_REFUNDED
+		}
+	case ORDER_EVENT_REVERSE:
+		to = ORDER_REVERSED
+	case ORDER_EVENT_CLOSE:
+		to = ORDER_CLOSED
+	default:
+		return false, msgError(MSG_ORDER_EVENT, e.Type)
+	}
+
+	//重复的事件.如支付成功之后又收到支付成功的通知
+	//支付成功之后查询接口返回的仍然是 B.退款状态不变
+	//状态不变.只补充交易金额 优惠等信息
+	//新的退款(refundReqNo 不同)不是重复的.即使状态不变也要记录
+	duplicated := to == o.State && e.Type != ORDER_EVENT_REFUND
+	if e.Type == ORDER_EVENT_PAY && to == ORDER_PAID && (o.State == ORDER_PARTIALLY_REFUNDED || o.State == ORDER_REFUNDED) {
+		duplicated = true
+	}
+	if duplicated {
+		if e.Type != ORDER_EVENT_PAY || !o.merge(e) {
+			return false, nil
+		}
+		o.UpdatedAt = now
+		return true, nil
+	}
+
+	//状态不变的只有退款.全额退款之后还可以记录金额为 0 的退款
+	if to != o.State && !CanTransit(o.State, to) {
+		return false, &TransitionError{From: o.State, To: to, Event: e.Type}
+	}
+
+	switch e.Type {
+	case ORDER_EVENT_PAY:
+		o.TransStatus = e.TransStatus
+		o.merge(e)
+	case ORDER_EVENT_REFUND:
+		o.Refunds = append(o.Refunds, OrderRefund{RefundReqNo: e.RefundReqNo, Amount: e.TransAmt, Time: now})
+	}
+
+	o.State = to
+	o.UpdatedAt = now
+	return true, nil
+}
+
+//补充网关返回的交易信息.返回是否有变化
+func (o *Order) merge(e OrderEvent) bool {
+	changed := false
+	if e.TransAmt > 0 && e.TransAmt != o.TransAmt {
+		o.TransAmt = e.TransAmt
+		changed = true
+	}
+	if e.Coupon > 0 && e.Coupon != o.Coupon {
+		o.Coupon = e.Coupon
+		changed = true
+	}
+	if e.OurTransNo != "" && e.OurTransNo != o.OurTransNo {
+		o.OurTransNo = e.OurTransNo
+		changed = true
+	}
+	return changed
+}
+
+var (
+	ErrOrderNotFound error = msgKeyError(MSG_ORDER_NOT_FOUND)
+	ErrOrderExists   error = msgKeyError(MSG_ORDER_EXISTS)
+	ErrOrderConflict error = msgKeyError(MSG_ORDER_CONFLICT)
+)
+
+/**
+订单的存储.实现见 MemoryOrderStore SQLOrderStore
+订单按 merchantId+orderNo 和 merchantId+orderReqNo 唯一.退款按 merchantId+refundReqNo 唯一
+Insert 时订单不存在.orderNo 或者 orderReqNo 已经存在的返回 ErrOrderExists
+Update 时 o.Version 为新的版本.存储中的版本不是 o.Version-1 的返回 ErrOrderConflict
+找不到的返回 ErrOrderNotFound
+*/
+type OrderStore interface {
+	Get(merchantId, orderNo string) (Order, error)
+	GetByReqNo(merchantId, orderReqNo string) (Order, error)
+	GetByRefundReqNo(merchantId, refundReqNo string) (Order, error)
+	Insert(o Order) error
+	Update(o Order) error
+}
+
+type OrderMachine struct {
+	Store OrderStore
+}
+
+//测试时替换
+var orderNow = time.Now
+
+func NewOrderMachine(store OrderStore) *OrderMachine {
+	return &OrderMachine{Store: store}
+}
+
+//创建订单.状态为 ORDER_CREATED
+func (m *OrderMachine) Create(o Order) (Order, error) {
+	if o.MerchantId == "" {
+		return o, msgError(MSG_FIELD_NIL, "merchantId")
+	}
+	if o.OrderNo == "" {
+		return o, msgError(MSG_FIELD_NIL, "orderNo")
+	}
+
+	now := orderNow()
+	o.State = ORDER_CREATED
+	o.Version = 1
+	o.CreatedAt = now
+	o.UpdatedAt = now
+	return o, m.Store.Insert(o)
+}
+
+/**
+按事件变化订单状态并保存
+版本冲突时重新读取之后再执行.最多 3 次
+*/
+func (m *OrderMachine) Apply(merchantId, orderNo string, e OrderEvent) (Order, error) {
+	for i := 0; i < 3; i++ {
+		o, err := m.Store.Get(merchantId, orderNo)
+		if err != nil {
+			return o, err
+		}
+
+		changed, err := o.apply(e, orderNow())
+		if err != nil || !changed {
+			return o, err
+		}
+
+		o.Version++
+		if err := m.Store.Update(o); err != ErrOrderConflict {
+			return o, err
+		}
+	}
+	return Order{}, ErrOrderConflict
+}
@@ -1,16 +1,20 @@
 package openbestpay
 
 import (
-	"encoding/json"
-	"errors"
 	"fmt"
-	"time"
 )
 
 /**
 翼支付交易模块
 */
 
+//交易状态 transStatus
+const (
+	TRANS_STATUS_PAYING  = "A" //请求(支付中)
+	TRANS_STATUS_SUCCESS = "B" //成功(支付成功)
+	TRANS_STATUS_FAIL    = "C" //失败
+)
+
 /**
 付款码支付
 https://webpaywg.bestpay.com.cn/barcode/placeOrder
@@ -29,138 +33,132 @@ func (a *bestpay_barcode_placeorder) apiName() string {
 }
 
 type Biz_bestpay_barcode_placeorder struct {
-	MerchantId    string `json:"merchantId,omitempty"`        //由翼支付网关平台统一分配 30
-	SubMerchantId string `json:"subMerchantId,omitempty"`     //由商户平台自己分配 30
-	Barcode       string `json:"barcode,omitempty"`           //商户POS扫描用户客户端条形码 30
-	OrderNo       string `json:"orderNo,omitempty"`           //由商户平台提供，支持纯数字、纯字母、字 母+数字组成，全局唯一(如果需要使用条 码退款业务，订单号必须为偶数位) 30
-	OrderReqNo    string `json:"orderReqNo,omitempty"`        //同上
-	Channel       string `json:"channel,omitempty"`           //默认填:05
-	BusiType      string `json:"busiType,omitempty"`          //默认填:0000001
-	OrderDate     string `json:"orderDate,omitempty"`         //由商户提供，长度14位，格式 yyyyMMddhhmmss (说明:该时间必须为 )
-	OrderAmt      int    `json:"orderAmt,omitempty,string"`   //单位:分。订单总金额 = 产品金额+附加金 额
-	ProductAmt    int    `json:"productAmt,omitempty,string"` //单位:分。
-	AttachAmt     int    `json:"attachAmt,omitempty,string"`  //单位:分。
-	GoodsName     string `json:"goodsName,omitempty"`         //商品信息 256
-	StoreId       string `json:"storeId,omitempty"`           //门店号 10
-	BackUrl       string `json:"backUrl,omitempty"`           //商户提供的用于异步接收交易返回结果的后 台url，若不需要后台返回，可不填，若需要 后台返回，请保障地址可用 255
-	LedgerDetail  string `json:"ledgerDetail,omitempty"`      //商户需要在结算时进行分账情况，需填写此字段，详情见接口说明分账明细 256
-	Attach        string `json:"attach,omitempty"`            //商户附加信息 128
-	Mac           string `json:"mac,omitempty"`               //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
-	MchntTmNum    string `json:"mchntTmNum,omitempty"`        //商户自定义终端号 50
-	DeviceTmNum   string `json:"deviceTmNum,omitempty"`       //设备终端号 50
-	ErpNo         string `json:"erpNo,omitempty"`             //商户营业员 编号 64
-	GoodsDetail   []struct {
-		GoodsId       string `json:"goodsId,omitempty"`         // 商品的编号
-		GoodsName     string `json:"goodsName,omitempty"`       // 商品名称
-		Quantity      int    `json:"quantity,omitempty,string"` // 商品数量
-		Price         int    `json:"price,omitempty,string"`    // 商品价格
-		GoodsCategory string `json:"goodsCategory,omitempty"`   // 商品分类
-		Body          string `json:"body,omitempty"`            // 商品描述
-	} `json:"goodsDetail,omitempty"` //商品详情，以 json 格式传过来，详见说明 5.2.4 4000
+	MerchantId    string            `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string            `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	Barcode       string            `json:"barcode,omitempty" bestpay:"required,max=30"`                //商户POS扫描用户客户端条形码 30
+	OrderNo       string            `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，支持纯数字、纯字母、字 母+数字组成，全局唯一(如果需要使用条 码退款业务，订单号必须为偶数位) 30
+	OrderReqNo    string            `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	Channel       string            `json:"channel,omitempty"`                                          //默认填:05
+	BusiType      string            `json:"busiType,omitempty"`                                         //默认填:0000001
+	OrderDate     string            `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //由商户提供，长度14位，格式 yyyyMMddhhmmss (说明:该时间必须为 )
+	OrderAmt      int               `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额
+	ProductAmt    int               `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int               `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string            `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	StoreId       string            `json:"storeId,omitempty" bestpay:"required,max=10"`                //门店号 10
+	BackUrl       string            `json:"backUrl,omitempty" bestpay:"max=255"`                        //商户提供的用于异步接收交易返回结果的后 台url，若不需要后台返回，可不填，若需要 后台返回，请保障地址可用 255
+	LedgerDetail  string            `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //商户需要在结算时进行分账情况，需填写此字段，详情见接口说明分账明细 256
+	Attach        string            `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string            `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+	MchntTmNum    string            `json:"mchntTmNum,omitempty" bestpay:"max=50"`                      //商户自定义终端号 50
+	DeviceTmNum   string            `json:"deviceTmNum,omitempty" bestpay:"max=50"`                     //设备终端号 50
+	ErpNo         string            `json:"erpNo,omitempty" bestpay:"max=64"`                           //商户营业员 编号 64
+	GoodsDetail   []GoodsDetailItem `json:"goodsDetail,omitempty" bestpay:"max=4000"`                   //商品详情，以 json 格式传过来，详见说明 5.2.4 4000
 
 }
 
-//mac 校验域.看起来像是一个请求签名的动作
-//返回一个待 mac 的数据
-func (b Biz_bestpay_barcode_placeorder) tobe_mac() string {
-	tobe_mac := "MERCHANTID=" + b.MerchantId
-	tobe_mac += "&ORDERNO=" + b.OrderNo
-	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
-	tobe_mac += "&ORDERDATE=" + b.OrderDate
-	tobe_mac += "&BARCODE=" + b.Barcode
-	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
-
-	return tobe_mac
+/**
+商品详情 说明 5.2.4
+*/
+type GoodsDetailItem struct {
+	GoodsId       string `json:"goodsId,omitempty" bestpay:"required,max=32"`    // 商品的编号 32
+	GoodsName     string `json:"goodsName,omitempty" bestpay:"required,max=256"` // 商品名称 256
+	Quantity      int    `json:"quantity,omitempty,string" bestpay:"min=1"`      // 商品数量
+	Price         int    `json:"price,omitempty,string" bestpay:"min=1"`         // 商品价格 单位:分
+	GoodsCategory string `json:"goodsCategory,omitempty" bestpay:"max=24"`       // 商品分类 24
+	Body          string `json:"body,omitempty" bestpay:"max=1000"`              // 商品描述 1000
 }
 
-func (b Biz_bestpay_barcode_placeorder) valid() error {
-	if v := len(b.MerchantId); v == 0 || v > 30 {
-		return errors.New("merchantId " + FORAMT_ERROR)
-	}
-
-	if v := len(b.SubMerchantId); v > 30 {
-		return errors.New("subMerchantId " + FORAMT_ERROR)
+//新建一个商品详情.分类和描述可以通过 SetCategory SetBody 补充
+func NewGoodsDetailItem(goodsId, goodsName string, quantity, price int) GoodsDetailItem {
+	return GoodsDetailItem{
+		GoodsId:   goodsId,
+		GoodsName: goodsName,
+		Quantity:  quantity,
+		Price:     price,
 	}
+}
 
-	if v := len(b.Barcode); v == 0 || v > 30 {
-		return errors.New("barcode " + FORAMT_ERROR)
-	}
+func (g GoodsDetailItem) SetCategory(category string) GoodsDetailItem {
+	g.GoodsCategory = category
+	return g
+}
 
-	if v := len(b.OrderNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("orderNo " + FORAMT_ERROR)
-	}
+func (g GoodsDetailItem) SetBody(body string) GoodsDetailItem {
+	g.Body = body
+	return g
+}
 
-	if v := len(b.OrderReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("orderReqNo " + FORAMT_ERROR)
-	}
+//单个商品的金额 price * quantity
+func (g GoodsDetailItem) Amount() int {
+	return g.Price * g.Quantity
+}
 
-	b.Channel = "05"
-	b.BusiType = "0000001"
+func (g GoodsDetailItem) valid() error {
+	return validStruct(g).err()
+}
 
-	if _, err := time.Parse("20060102150405", b.OrderDate); err != nil {
-		return errors.New("orderDate " + FORAMT_ERROR)
-	}
+//追加商品详情
+func (b *Biz_bestpay_barcode_placeorder) AddGoodsDetail(items ...GoodsDetailItem) {
+	b.GoodsDetail = append(b.GoodsDetail, items...)
+}
 
-	if b.OrderAmt <= 0 {
-		return errors.New("orderAmt " + FORAMT_ERROR)
+//商品详情的合计金额 sum(price * quantity)
+func (b Biz_bestpay_barcode_placeorder) GoodsDetailAmt() int {
+	total := 0
+	for _, g := range b.GoodsDetail {
+		total += g.Amount()
 	}
+	return total
+}
 
-	if b.ProductAmt <= 0 {
-		return errors.New("productAmt " + FORAMT_ERROR)
+//校验商品详情的合计金额与 productAmt 是否一致.
+//文档中并没有强制要求一致.所以不放在 valid 中,需要的时候由调用方自行调用
+func (b Biz_bestpay_barcode_placeorder) ValidGoodsDetailAmt() error {
+	ve := &ValidationError{}
+	if len(b.GoodsDetail) == 0 {
+		ve.add("goodsDetail", RULE_REQUIRED, MSG_CAN_NOT_NIL)
+	} else if v := b.GoodsDetailAmt(); v != b.ProductAmt {
+		ve.add("productAmt", RULE_SUM, MSG_GOODS_DETAIL_SUM, b.ProductAmt, v)
 	}
 
-	if b.AttachAmt < 0 {
-		return errors.New("attachAmt " + FORAMT_ERROR)
-	}
+	return ve.err()
+}
 
-	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
-		return errors.New("orderAmt = productAmt + attachAmt")
-	}
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_barcode_placeorder) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += "&BARCODE=" + b.Barcode
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
 
-	if v := len(b.GoodsName); v > 256 {
-		return errors.New("goodsName " + FORAMT_ERROR)
-	}
+	return tobe_mac
+}
 
-	if v := len(b.StoreId); v == 0 || v > 10 {
-		return errors.New("storeId " + FORAMT_ERROR)
+//channel busiType 没有填的时候使用默认值
+func (b Biz_bestpay_barcode_placeorder) defaults() bizInterface {
+	if b.Channel == "" {
+		b.Channel = "05"
 	}
-
-	if v := len(b.BackUrl); v > 255 {
-		return errors.New("backUrl " + FORAMT_ERROR)
+	if b.BusiType == "" {
+		b.BusiType = "0000001"
 	}
+	return b
+}
 
-	if v := len(b.LedgerDetail); v > 255 {
-		return errors.New("ledgerDetail " + FORAMT_ERROR)
-	}
+func (b Biz_bestpay_barcode_placeorder) valid() error {
+	ve := validStruct(b)
 
-	if v := len(b.Attach); v > 128 {
-		return errors.New("attach " + FORAMT_ERROR)
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
 	}
 
 	//b.Mac 不做校验..这是一个类似签名的东西
-
-	if v := len(b.MchntTmNum); v > 50 {
-		return errors.New("mchntTmNum " + FORAMT_ERROR)
-	}
-
-	if v := len(b.DeviceTmNum); v > 50 {
-		return errors.New("deviceTmNum " + FORAMT_ERROR)
-	}
-
-	if v := len(b.ErpNo); v > 64 {
-		return errors.New("erpNo " + FORAMT_ERROR)
-	}
-
-	if len(b.GoodsDetail) > 0 {
-		if v, err := json.Marshal(&b.GoodsDetail); err != nil {
-			return errors.New("goodsDetail " + FORAMT_ERROR)
-		} else if len(v) > 4000 {
-			return errors.New("goodsDetail too long")
-		}
-		//TODO:目前文档中并没有看到 这个结构中的字段是否 都是必填.
-	}
-
-	return nil
+	//goodsDetail 中的商品在 validStruct 中逐个校验
+	return ve.err()
 }
 
 type Resp_bestpay_barcode_placeorder struct {
@@ -205,11 +203,11 @@ func (a *bestpay_queryorder) apiName() string {
 }
 
 type Biz_bestpay_queryorder struct {
-	MerchantId string `json:"merchantId,omitempty"` //由翼支付网关平台统一分配 30
-	OrderNo    string `json:"orderNo,omitempty"`    //由商户平台提供，支持纯数字、纯字母、字 母+数字组成，全局唯一(如果需要使用条 码退款业务，订单号必须为偶数位) 30
-	OrderReqNo string `json:"orderReqNo,omitempty"` //同上
-	OrderDate  string `json:"orderDate,omitempty"`  //由商户提供，长度14位，格式 yyyyMMddhhmmss (说明:该时间必须为 )
-	Mac        string `json:"mac,omitempty"`        //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+	MerchantId string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	OrderNo    string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，支持纯数字、纯字母、字 母+数字组成，全局唯一(如果需要使用条 码退款业务，订单号必须为偶数位) 30
+	OrderReqNo string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	OrderDate  string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //由商户提供，长度14位，格式 yyyyMMddhhmmss (说明:该时间必须为 )
+	Mac        string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
 }
 
 //mac 校验域.看起来像是一个请求签名的动作
@@ -224,23 +222,8 @@ func (b Biz_bestpay_queryorder) tobe_mac() string {
 }
 
 func (b Biz_bestpay_queryorder) valid() error {
-	if v := len(b.MerchantId); v == 0 || v > 30 {
-		return errors.New("merchantId " + FORAMT_ERROR)
-	}
-
-	if v := len(b.OrderNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("orderNo " + FORAMT_ERROR)
-	}
-
-	if v := len(b.OrderReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("orderReqNo " + FORAMT_ERROR)
-	}
-
-	if _, err := time.Parse("20060102150405", b.OrderDate); err != nil {
-		return errors.New("orderDate " + FORAMT_ERROR)
-	}
 	//b.Mac 不做校验..这是一个类似签名的东西
-	return nil
+	return validStruct(b).err()
 }
 
 type Resp_bestpay_queryorder struct {
@@ -281,18 +264,18 @@ func (a *bestpay_commonrefund) apiName() string {
 }
 
 type Biz_bestpay_commonrefund struct {
-	MerchantId    string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
-	SubMerchantId string `json:"subMerchantId,omitempty"`   //由商户平台自己分配 30
-	MerchantPwd   string `json:"merchantPwd,omitempty"`     //商户执行时需填入相应密码 ，又称:交易key
-	OldOrderNo    string `json:"oldOrderNo,omitempty"`      //原扣款成功的订单号 30
-	OldOrderReqNo string `json:"oldOrderReqNo,omitempty"`   //原扣款成功的请求支付流水号
-	RefundReqNo   string `json:"refundReqNo,omitempty"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
-	RefundReqDate string `json:"refundReqDate,omitempty"`   //yyyyMMDD
-	TransAmt      int    `json:"transAmt,omitempty,string"` //单位为分，小于等于原订单金额
-	LedgerDetail  string `json:"ledgerDetail,omitempty"`    //商户需要在结算时进行分账情况，需填写此字段，详情见接口说明分账明细 256
-	Channel       string `json:"channel,omitempty"`         //默认填:05
-	Mac           string `json:"mac,omitempty"`             //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
-	BgUrl         string `json:"bgUrl,omitempty"`           //商户的退款回调地址，当退款受理 255
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`           //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                 //由商户平台自己分配 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`          //商户执行时需填入相应密码 ，又称:交易key
+	OldOrderNo    string `json:"oldOrderNo,omitempty" bestpay:"required,max=30,even"`      //原扣款成功的订单号 30
+	OldOrderReqNo string `json:"oldOrderReqNo,omitempty" bestpay:"required,max=30,even"`   //原扣款成功的请求支付流水号
+	RefundReqNo   string `json:"refundReqNo,omitempty" bestpay:"required,max=30,even"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
+	RefundReqDate string `json:"refundReqDate,omitempty" bestpay:"required,date=yyyyMMdd"` //yyyyMMDD
+	TransAmt      int    `json:"transAmt,omitempty,string" bestpay:"min=1"`                //单位为分，小于等于原订单金额
+	LedgerDetail  string `json:"ledgerDetail,omitempty" bestpay:"max=256"`                 //商户需要在结算时进行分账情况，需填写此字段，详情见接口说明分账明细 256
+	Channel       string `json:"channel,omitempty"`                                        //默认填:05
+	Mac           string `json:"mac,omitempty"`                                            //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+	BgUrl         string `json:"bgUrl,omitempty" bestpay:"max=255"`                        //商户的退款回调地址，当退款受理 255
 }
 
 //mac 校验域.看起来像是一个请求签名的动作
@@ -309,51 +292,17 @@ func (b Biz_bestpay_commonrefund) tobe_mac() string {
 	return tobe_mac
 }
 
-func (b Biz_bestpay_commonrefund) valid() error {
-	if v := len(b.MerchantId); v == 0 || v > 30 {
-		return errors.New("merchantId " + FORAMT_ERROR)
-	}
-
-	if v := len(b.SubMerchantId); v > 30 {
-		return errors.New("subMerchantId " + FORAMT_ERROR)
-	}
-
-	if v := len(b.MerchantPwd); v == 0 || v > 20 {
-		return errors.New("merchantPwd " + FORAMT_ERROR)
-	}
-
-	if v := len(b.OldOrderNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("oldOrderNo " + FORAMT_ERROR)
-	}
-
-	if v := len(b.OldOrderReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("oldOrderReqNo " + FORAMT_ERROR)
-	}
-
-	if v := len(b.RefundReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("refundReqNo " + FORAMT_ERROR)
-	}
-
-	if _, err := time.Parse("20060102", b.RefundReqDate); err != nil {
-		return errors.New("refundReqDate " + FORAMT_ERROR)
-	}
-
-	if b.TransAmt <= 0 {
-		return errors.New("transAmt " + FORAMT_ERROR)
-	}
-
-	if v := len(b.LedgerDetail); v > 255 {
-		return errors.New("ledgerDetail " + FORAMT_ERROR)
-	}
-
-	b.Channel = "05"
-
-	if v := len(b.BgUrl); v > 255 {
-		return errors.New("bgUrl " + FORAMT_ERROR)
+//channel 没有填的时候使用默认值
+func (b Biz_bestpay_commonrefund) defaults() bizInterface {
+	if b.Channel == "" {
+		b.Channel = "05"
 	}
+	return b
+}
 
+func (b Biz_bestpay_commonrefund) valid() error {
 	//b.Mac 不做校验..这是一个类似签名的东西
-	return nil
+	return validStruct(b).err()
 }
 
 type Resp_bestpay_commonrefund struct {
@@ -381,16 +330,16 @@ func (a *bestpay_reverse) apiName() string {
 }
 
 type Biz_bestpay_reverse struct {
-	MerchantId    string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
-	SubMerchantId string `json:"subMerchantId,omitempty"`   //由商户平台自己分配 30
-	MerchantPwd   string `json:"merchantPwd,omitempty"`     //商户执行时需填入相应密码 ，又称:交易key
-	OldOrderNo    string `json:"oldOrderNo,omitempty"`      //原扣款成功的订单号 30
-	OldOrderReqNo string `json:"oldOrderReqNo,omitempty"`   //原扣款成功的请求支付流水号
-	RefundReqNo   string `json:"refundReqNo,omitempty"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
-	RefundReqDate string `json:"refundReqDate,omitempty"`   //yyyyMMDD
-	TransAmt      int    `json:"transAmt,omitempty,string"` //单位为分，小于等于原订单金额
-	Channel       string `json:"channel,omitempty"`         //默认填:05
-	Mac           string `json:"mac,omitempty"`             //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`           //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                 //由商户平台自己分配 30
+	MerchantPwd   string `json:"merchantPwd,omitempty" bestpay:"required,max=20"`          //商户执行时需填入相应密码 ，又称:交易key
+	OldOrderNo    string `json:"oldOrderNo,omitempty" bestpay:"required,max=30,even"`      //原扣款成功的订单号 30
+	OldOrderReqNo string `json:"oldOrderReqNo,omitempty" bestpay:"required,max=30,even"`   //原扣款成功的请求支付流水号
+	RefundReqNo   string `json:"refundReqNo,omitempty" bestpay:"required,max=30,even"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
+	RefundReqDate string `json:"refundReqDate,omitempty" bestpay:"required,date=yyyyMMdd"` //yyyyMMDD
+	TransAmt      int    `json:"transAmt,omitempty,string" bestpay:"min=1"`                //单位为分，小于等于原订单金额
+	Channel       string `json:"channel,omitempty"`                                        //默认填:05
+	Mac           string `json:"mac,omitempty"`                                            //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
 }
 
 //mac 校验域.看起来像是一个请求签名的动作
@@ -406,50 +355,84 @@ func (b Biz_bestpay_reverse) tobe_mac() string {
 	return tobe_mac
 }
 
-func (b Biz_bestpay_reverse) valid() error {
-	if v := len(b.MerchantId); v == 0 || v > 30 {
-		return errors.New("merchantId " + FORAMT_ERROR)
+//channel 没有填的时候使用默认值
+func (b Biz_bestpay_reverse) defaults() bizInterface {
+	if b.Channel == "" {
+		b.Channel = "05"
 	}
+	return b
+}
 
-	if v := len(b.SubMerchantId); v > 30 {
-		return errors.New("subMerchantId " + FORAMT_ERROR)
-	}
+func (b Biz_bestpay_reverse) valid() error {
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return validStruct(b).err()
+}
 
-	if v := len(b.MerchantPwd); v == 0 || v > 20 {
-		return errors.New("merchantPwd " + FORAMT_ERROR)
-	}
+type Resp_bestpay_reverse struct {
+	OldOrderNo  string `json:"oldOrderNo,omitempty"`      //原扣款成功的订单号 30
+	RefundReqNo string `json:"refundReqNo,omitempty"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
+	TransAmt    int    `json:"transAmt,omitempty,string"` //单位为分，小于等于原订单金额
+	Sign        string `json:"sign,omitempty"`            //十六进制
+}
 
-	if v := len(b.OldOrderNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("oldOrderNo " + FORAMT_ERROR)
-	}
+/**
+订单关闭
+https://webpaywg.bestpay.com.cn/close/closeOrder
+关闭未支付的订单.关闭之后用户不能再支付.已经支付的订单请用退款或者撤单
+*/
+type bestpay_closeorder struct {
+	BestpayApi
+}
 
-	if v := len(b.OldOrderReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("oldOrderReqNo " + FORAMT_ERROR)
-	}
+func (a *bestpay_closeorder) apiMethod() string {
+	return BESTPAY_URL_CLOSEORDER
+}
 
-	if v := len(b.RefundReqNo); v == 0 || v > 30 || v%2 != 0 {
-		return errors.New("refundReqNo " + FORAMT_ERROR)
-	}
+func (a *bestpay_closeorder) apiName() string {
+	return "订单关闭"
+}
 
-	if _, err := time.Parse("20060102", b.RefundReqDate); err != nil {
-		return errors.New("refundReqDate " + FORAMT_ERROR)
-	}
+type Biz_bestpay_closeorder struct {
+	MerchantId    string `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //要关闭的订单号 30
+	OrderReqNo    string `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //要关闭的订单请求流水号 30
+	OrderDate     string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //下单时的 orderDate
+	Mac           string `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+}
 
-	if b.TransAmt <= 0 {
-		return errors.New("transAmt " + FORAMT_ERROR)
-	}
+//mac 校验域.看起来像是一个请求签名的动作
+//返回一个待 mac 的数据
+func (b Biz_bestpay_closeorder) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
 
-	b.Channel = "05"
+	return tobe_mac
+}
 
+func (b Biz_bestpay_closeorder) valid() error {
 	//b.Mac 不做校验..这是一个类似签名的东西
-	return nil
+	return validStruct(b).err()
 }
 
-type Resp_bestpay_reverse struct {
-	OldOrderNo  string `json:"oldOrderNo,omitempty"`      //原扣款成功的订单号 30
-	RefundReqNo string `json:"refundReqNo,omitempty"`     //该流水在商户处必须唯一。退款流水 refundReqNo不能和支付流水oldOrderNo 相同。若存在部分退款场景，具体见说明8.5原扣款成功的请求支付流水号
-	TransAmt    int    `json:"transAmt,omitempty,string"` //单位为分，小于等于原订单金额
-	Sign        string `json:"sign,omitempty"`            //十六进制
+//用交易查询的参数关闭同一笔订单
+func (b Biz_bestpay_queryorder) CloseOrder() Biz_bestpay_closeorder {
+	return Biz_bestpay_closeorder{
+		MerchantId: b.MerchantId,
+		OrderNo:    b.OrderNo,
+		OrderReqNo: b.OrderReqNo,
+		OrderDate:  b.OrderDate,
+	}
+}
+
+type Resp_bestpay_closeorder struct {
+	MerchantId  string `json:"merchantId,omitempty"`  //由翼支付网关平台统一分配 30
+	OrderNo     string `json:"orderNo,omitempty"`     //订单号 30
+	OrderReqNo  string `json:"orderReqNo,omitempty"`  //订单请求流水号 30
+	TransStatus string `json:"transStatus,omitempty"` //关闭之后的订单状态 C:失败(已关闭)
+	Sign        string `json:"sign,omitempty"`        //十六进制
 }
 
 func init() {
@@ -457,4 +440,5 @@ func init() {
 	registerApi(new(bestpay_queryorder))
 	registerApi(new(bestpay_commonrefund))
 	registerApi(new(bestpay_reverse))
+	registerApi(new(bestpay_closeorder))
 }
@@ -0,0 +1,171 @@
+package openbestpay
+
+import (
+	"strconv"
+	"strings"
+)
+
+/**
+付款明细 payChannel 解析
+接口文档只说明 payChannel 为付款明细.没有给出格式.
+下面的格式是 SDK 按网关实际返回的数据约定的: bankId:金额|bankId:金额.如:
+	EPAYACC:900|VOUCHER_3AC:100
+只有一个 bankId 并且没有金额的.金额为整笔交易金额
+每一项都带金额的.合计必须等于交易金额
+每一项都通过 GetBankId 归类为余额/快捷/卡/代金券/立减
+*/
+
+//资金类型
+const (
+	FUND_TYPE_BALANCE  = "balance"  //余额
+	FUND_TYPE_QUICK    = "quick"    //快捷支付
+	FUND_TYPE_CARD     = "card"     //卡支付 (银行卡/翼支付卡)
+	FUND_TYPE_VOUCHER  = "voucher"  //代金券
+	FUND_TYPE_DISCOUNT = "discount" //立减
+	FUND_TYPE_UNKNOWN  = "unknown"  //未知
+)
+
+//渠道类别对应的资金类型.账户类的可以在 bankid 目录中单独指定
+func fundTypeOfChannel(channel string) string {
+	switch channel {
+	case BANK_CHANNEL_BALANCE:
+		return FUND_TYPE_BALANCE
+	case BANK_CHANNEL_QUICK:
+		return FUND_TYPE_QUICK
+	case BANK_CHANNEL_B2C, BANK_CHANNEL_B2B:
+		return FUND_TYPE_CARD
+	}
+	return FUND_TYPE_UNKNOWN
+}
+
+//资金类型的说明
+func FundTypeDesc(l, fundType string) string {
+	return Message(l, MSG_FUND_TYPE_PREFIX+fundType)
+}
+
+//一笔资金来源
+type FundingLeg struct {
+	BankId   BankId //bankId 的说明
+	FundType string //资金类型 FUND_TYPE_*
+	Amount   int    //单位:分
+}
+
+//代金券和立减属于优惠.不是用户实际支付的钱
+func (f FundingLeg) IsCoupon() bool {
+	return f.FundType == FUND_TYPE_VOUCHER || f.FundType == FUND_TYPE_DISCOUNT
+}
+
+//付款明细
+type PayChannelDetail struct {
+	Legs []FundingLeg
+}
+
+//所有资金来源的合计
+func (p PayChannelDetail) Total() int {
+	total := 0
+	for _, leg := range p.Legs {
+		total += leg.Amount
+	}
+	return total
+}
+
+//某一类资金的合计
+func (p PayChannelDetail) Amount(fundType string) int {
+	total := 0
+	for _, leg := range p.Legs {
+		if leg.FundType == fundType {
+			total += leg.Amount
+		}
+	}
+	return total
+}
+
+//优惠(代金券+立减)的合计
+func (p PayChannelDetail) CouponAmt() int {
+	total := 0
+	for _, leg := range p.Legs {
+		if leg.IsCoupon() {
+			total += leg.Amount
+		}
+	}
+	return total
+}
+
+//用户实际支付的合计
+func (p PayChannelDetail) RealAmt() int {
+	return p.Total() - p.CouponAmt()
+}
+
+//解析付款明细.transAmt 用于补全没有金额的那一项.以及核对合计金额.为 0 时不核对
+func ParsePayChannel(payChannel string, transAmt int) (PayChannelDetail, error) {
+	return ParsePayChannelLang(payChannel, transAmt, GetLang())
+}
+
+//按指定语言解析付款明细
+func ParsePayChannelLang(payChannel string, transAmt int, l string) (PayChannelDetail, error) {
+	detail := PayChannelDetail{}
+
+	payChannel = strings.TrimSpace(payChannel)
+	if payChannel == "" {
+		return detail, msgError(MSG_FIELD_NIL, "payChannel")
+	}
+
+	missing := -1
+	sum := 0
+	for _, part := range strings.Split(payChannel, "|") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+
+		bankid, amount := part, -1
+		if i := strings.LastIndex(part, ":"); i >= 0 {
+			v, err := strconv.Atoi(strings.TrimSpace(part[i+1:]))
+			if err != nil || v < 0 {
+				return detail, msgError(MSG_FIELD_FORMAT, "payChannel", part)
+			}
+			bankid, amount = strings.TrimSpace(part[:i]), v
+		}
+
+		if amount < 0 {
+			if missing >= 0 {
+				return detail, msgError(MSG_FIELD_FORMAT, "payChannel", part)
+			}
+			missing = len(detail.Legs)
+			amount = 0
+		}
+
+		bid := GetBankIdLang(bankid, l)
+		detail.Legs = append(detail.Legs, FundingLeg{
+			BankId:   bid,
+			FundType: bid.FundType,
+			Amount:   amount,
+		})
+		sum += amount
+	}
+
+	if len(detail.Legs) == 0 {
+		return detail, msgError(MSG_FIELD_FORMAT, "payChannel", payChannel)
+	}
+
+	if missing >= 0 {
+		if transAmt < sum {
+			return detail, msgError(MSG_FIELD_FORMAT, "payChannel", "transAmt < sum(amount)")
+		}
+		detail.Legs[missing].Amount = transAmt - sum
+	} else if transAmt > 0 && transAmt != sum {
+		return detail, msgError(MSG_FIELD_FORMAT, "payChannel", "transAmt != sum(amount)")
+	}
+
+	return detail, nil
+}
+
+//付款明细
+func (r Resp_bestpay_barcode_placeorder) PayChannelDetail() (PayChannelDetail, error) {
+	return ParsePayChannel(r.PayChannel, r.TransAmt)
+}
+
+//付款明细
+func (r Resp_bestpay_queryorder) PayChannelDetail() (PayChannelDetail, error) {
+	return ParsePayChannel(r.PayChannel, r.TransAmt)
+}
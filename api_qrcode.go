@@ -0,0 +1,95 @@
+package openbestpay
+
+import (
+	"fmt"
+)
+
+/**
+二维码支付(主扫)
+https://webpaywg.bestpay.com.cn/qrcode/placeOrder
+商户预下单.网关返回二维码链接 codeUrl.商户把 codeUrl 生成二维码展示给用户.用户用翼支付客户端扫码支付
+支付结果通过 backUrl 异步通知.或者用交易查询接口查询
+*/
+type bestpay_qrcode_placeorder struct {
+	BestpayApi
+}
+
+func (a *bestpay_qrcode_placeorder) apiMethod() string {
+	return BESTPAY_URL_QRCODE_PLACEORDER
+}
+
+func (a *bestpay_qrcode_placeorder) apiName() string {
+	return "二维码支付"
+}
+
+type Biz_bestpay_qrcode_placeorder struct {
+	MerchantId    string            `json:"merchantId,omitempty" bestpay:"required,max=30"`             //由翼支付网关平台统一分配 30
+	SubMerchantId string            `json:"subMerchantId,omitempty" bestpay:"max=30"`                   //由商户平台自己分配 30
+	OrderNo       string            `json:"orderNo,omitempty" bestpay:"required,max=30,even"`           //由商户平台提供，支持纯数字、纯字母、字 母+数字组成，全局唯一(如果需要使用条 码退款业务，订单号必须为偶数位) 30
+	OrderReqNo    string            `json:"orderReqNo,omitempty" bestpay:"required,max=30,even"`        //同上
+	Channel       string            `json:"channel,omitempty"`                                          //默认填:05
+	BusiType      string            `json:"busiType,omitempty"`                                         //默认填:0000001
+	OrderDate     string            `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"` //由商户提供，长度14位，格式 yyyyMMddhhmmss
+	OrderAmt      int               `json:"orderAmt,omitempty,string" bestpay:"min=1"`                  //单位:分。订单总金额 = 产品金额+附加金 额
+	ProductAmt    int               `json:"productAmt,omitempty,string" bestpay:"min=1"`                //单位:分。
+	AttachAmt     int               `json:"attachAmt,omitempty,string" bestpay:"min=0"`                 //单位:分。
+	GoodsName     string            `json:"goodsName,omitempty" bestpay:"max=256"`                      //商品信息 256
+	StoreId       string            `json:"storeId,omitempty" bestpay:"required,max=10"`                //门店号 10
+	BackUrl       string            `json:"backUrl,omitempty" bestpay:"max=255"`                        //商户提供的用于异步接收交易返回结果的后 台url 255
+	LedgerDetail  string            `json:"ledgerDetail,omitempty" bestpay:"max=256"`                   //商户需要在结算时进行分账情况，需填写此字段，详情见接口说明分账明细 256
+	Attach        string            `json:"attach,omitempty" bestpay:"max=128"`                         //商户附加信息 128
+	Mac           string            `json:"mac,omitempty"`                                              //采用标准的MD5算法，由商户实现， MD5 加密获得32位大写字符 32
+	MchntTmNum    string            `json:"mchntTmNum,omitempty" bestpay:"max=50"`                      //商户自定义终端号 50
+	DeviceTmNum   string            `json:"deviceTmNum,omitempty" bestpay:"max=50"`                     //设备终端号 50
+	ErpNo         string            `json:"erpNo,omitempty" bestpay:"max=64"`                           //商户营业员 编号 64
+	GoodsDetail   []GoodsDetailItem `json:"goodsDetail,omitempty" bestpay:"max=4000"`                   //商品详情，以 json 格式传过来，详见说明 5.2.4 4000
+}
+
+//mac 校验域.与付款码支付相同.只是没有 barcode
+//返回一个待 mac 的数据
+func (b Biz_bestpay_qrcode_placeorder) tobe_mac() string {
+	tobe_mac := "MERCHANTID=" + b.MerchantId
+	tobe_mac += "&ORDERNO=" + b.OrderNo
+	tobe_mac += "&ORDERREQNO=" + b.OrderReqNo
+	tobe_mac += "&ORDERDATE=" + b.OrderDate
+	tobe_mac += fmt.Sprintf("&%s=%d", "ORDERAMT", b.OrderAmt)
+
+	return tobe_mac
+}
+
+//channel busiType 没有填的时候使用默认值
+func (b Biz_bestpay_qrcode_placeorder) defaults() bizInterface {
+	if b.Channel == "" {
+		b.Channel = "05"
+	}
+	if b.BusiType == "" {
+		b.BusiType = "0000001"
+	}
+	return b
+}
+
+func (b Biz_bestpay_qrcode_placeorder) valid() error {
+	ve := validStruct(b)
+
+	if b.AttachAmt+b.ProductAmt != b.OrderAmt {
+		ve.add("orderAmt", RULE_SUM, MSG_ORDER_AMT_SUM)
+	}
+
+	//b.Mac 不做校验..这是一个类似签名的东西
+	return ve.err()
+}
+
+type Resp_bestpay_qrcode_placeorder struct {
+	MerchantId  string `json:"merchantId,omitempty"`      //由翼支付网关平台统一分配 30
+	OrderNo     string `json:"orderNo,omitempty"`         //商户订单号 30
+	OrderReqNo  string `json:"orderReqNo,omitempty"`      //商户请求流水号 30
+	OrderDate   string `json:"orderDate,omitempty"`       //格式 yyyyMMddhhmmss
+	TransAmt    int    `json:"transAmt,omitempty,string"` //单位:分。
+	CodeUrl     string `json:"codeUrl,omitempty"`         //二维码链接.商户需要把它生成二维码展示给用户
+	TransStatus string `json:"transStatus,omitempty"`     //A:请求(支付中) B:成功(支付成功) C:失败(订单状态结果)
+	Sign        string `json:"sign,omitempty"`            //十六进制
+}
+
+func init() {
+	registerApi(new(bestpay_qrcode_placeorder))
+}
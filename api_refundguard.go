@@ -0,0 +1,157 @@
+package openbestpay
+
+import (
+	"context"
+	"sync"
+)
+
+/**
+退款前检查
+签名之前确认退款金额不超过可退金额 = 实付金额 - 优惠 - 已经退款的金额
+	g := NewRefundGuard(store, key)
+	if err := g.Check(biz, orderDate); err != nil { ... }
+	if err := g.CheckContext(ctx, biz, orderDate); err != nil { ... } //ctx 用于交易查询
+原订单先从 OrderStore 查找.以下情况用交易查询:
+	存储中的订单还在 created/paying.支付结果以网关为准.orderDate 为空时用存储中的 OrderDate
+	存储中没有.并且提供了 orderDate
+交易查询不返回已经退款的金额.存储中没有的只能保证单笔不超过实付金额
+设置 SetRefundGuard 之后 SetBizContent 会自动检查退款.这时没有 orderDate.交易查询使用 SetBizContentContext 的 ctx
+原订单必须在 OrderStore 中.否则返回 MSG_REFUND_NO_ORDER
+并发的两笔退款可能同时通过检查.需要调用方按订单串行
+*/
+
+type RefundGuard struct {
+	Store OrderStore //订单存储.为空时只用交易查询
+	Key   string     //交易查询用的商户秘钥.为空时不查询
+
+	query func(ctx context.Context, biz Biz_bestpay_queryorder, key string) (Resp_bestpay_queryorder, error)
+}
+
+func NewRefundGuard(store OrderStore, key string) *RefundGuard {
+	return &RefundGuard{
+		Store: store,
+		Key:   key,
+		query: queryOrder,
+	}
+}
+
+//执行一次交易查询
+func queryOrder(ctx context.Context, biz Biz_bestpay_queryorder, key string) (Resp_bestpay_queryorder, error) {
+	r := Resp_bestpay_queryorder{}
+	err := callApi(ctx, BESTPAY_URL_QUERYORDER, biz, key, &r)
+	return r, err
+}
+
+/**
+检查退款.orderDate 为原订单的下单时间 yyyyMMddhhmmss.只在交易查询时使用.可以为空
+同一个 refundReqNo 已经退款成功的直接通过.网关会按 refundReqNo 去重
+*/
+func (g *RefundGuard) Check(biz Biz_bestpay_commonrefund, orderDate string) error {
+	return g.CheckContext(context.Background(), biz, orderDate)
+}
+
+//同 Check.ctx 结束时交易查询立即返回
+func (g *RefundGuard) CheckContext(ctx context.Context, biz Biz_bestpay_commonrefund, orderDate string) error {
+	o := Order{
+		MerchantId: biz.MerchantId,
+		OrderNo:    biz.OldOrderNo,
+		State:      ORDER_PAYING,
+	}
+	found := false
+	if g.Store != nil {
+		v, err := g.Store.Get(biz.MerchantId, biz.OldOrderNo)
+		if err == nil {
+			o, found = v, true
+		} else if err != ErrOrderNotFound {
+			return err
+		}
+	}
+
+	//已经有支付结果的以存储为准.存储中有已经退款的金额
+	if found && o.State != ORDER_CREATED && o.State != ORDER_PAYING {
+		return checkRefund(o, biz)
+	}
+
+	if orderDate == "" {
+		orderDate = o.OrderDate
+	}
+	if orderDate == "" || g.Key == "" {
+		if found {
+			return checkRefund(o, biz)
+		}
+		return msgError(MSG_REFUND_NO_ORDER, biz.OldOrderNo)
+	}
+
+	query := g.query
+	if query == nil {
+		query = queryOrder
+	}
+	r, err := query(ctx, Biz_bestpay_queryorder{
+		MerchantId: biz.MerchantId,
+		OrderNo:    biz.OldOrderNo,
+		OrderReqNo: biz.OldOrderReqNo,
+		OrderDate:  orderDate,
+	}, g.Key)
+	if err != nil {
+		return err
+	}
+
+	o.merge(OrderEvent{TransAmt: r.TransAmt, Coupon: r.Coupon})
+	o.TransStatus = r.TransStatus
+	switch r.TransStatus {
+	case TRANS_STATUS_SUCCESS:
+		o.State = ORDER_PAID
+	case TRANS_STATUS_FAIL:
+		o.State = ORDER_FAILED
+	}
+	return checkRefund(o, biz)
+}
+
+func checkRefund(o Order, biz Biz_bestpay_commonrefund) error {
+	if o.refunded(biz.RefundReqNo) {
+		return nil
+	}
+
+	if o.State != ORDER_PAID && o.State != ORDER_PARTIALLY_REFUNDED {
+		return msgError(MSG_REFUND_NOT_PAID, o.OrderNo, o.State)
+	}
+
+	if refundable := o.RefundableAmt(); biz.TransAmt > refundable {
+		return msgError(MSG_REFUND_EXCEEDED, biz.TransAmt, refundable)
+	}
+	return nil
+}
+
+var (
+	refundGuard      *RefundGuard
+	refundGuardMutex sync.RWMutex
+)
+
+//设置之后 SetBizContent 会检查退款.nil 关闭
+func SetRefundGuard(g *RefundGuard) {
+	refundGuardMutex.Lock()
+	refundGuard = g
+	refundGuardMutex.Unlock()
+}
+
+func GetRefundGuard() *RefundGuard {
+	refundGuardMutex.RLock()
+	defer refundGuardMutex.RUnlock()
+	return refundGuard
+}
+
+//SetBizContent 时的检查
+func guardRefund(ctx context.Context, biz bizInterface) error {
+	g := GetRefundGuard()
+	if g == nil {
+		return nil
+	}
+
+	switch v := biz.(type) {
+	case Biz_bestpay_commonrefund:
+		return g.CheckContext(ctx, v, "")
+	case *Biz_bestpay_commonrefund:
+		return g.CheckContext(ctx, *v, "")
+	}
+	return nil
+}
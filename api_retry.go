@@ -0,0 +1,252 @@
+package openbestpay
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"sync"
+	"time"
+
+	"github.com/liteck/logs"
+)
+
+/**
+自动重试
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	api.SetBizContent(biz, key)
+	err := api.RunRetryContext(ctx, DefaultRetryPolicy())
+	logs.Debug(api.Attempts())
+只有幂等的接口才会重试.是否幂等由接口注册的幂等规则决定:
+	查询类的接口       总是幂等
+	退款/撤单          带 refundReqNo 时幂等.网关按 refundReqNo 去重
+	下单/扣款          默认不重试.orderReqNo 是必填的.是否按它去重要看商户在网关的配置.
+	                   确认之后可以打开: SetIdempotentRule(BESTPAY_URL_BARCODE_PLACEORDER, IdempotentBy("OrderReqNo"))
+	                   重试时必须用同一个 orderReqNo
+没有注册规则的接口只执行一次
+ctx 结束时不再等待.直接返回 ctx.Err()
+*/
+
+//判断一次请求是否可以安全重试
+type IdempotentRule func(biz interface{}) bool
+
+var (
+	idempotentRules      = map[string]IdempotentRule{}
+	idempotentRulesMutex sync.RWMutex
+)
+
+//设置接口的幂等规则.rule 为空时删除.之后这个接口不再重试
+func SetIdempotentRule(method string, rule IdempotentRule) {
+	idempotentRulesMutex.Lock()
+	defer idempotentRulesMutex.Unlock()
+
+	if rule == nil {
+		delete(idempotentRules, method)
+		return
+	}
+	idempotentRules[method] = rule
+}
+
+//接口在当前参数下是否幂等
+func IsIdempotent(method string, biz interface{}) bool {
+	idempotentRulesMutex.RLock()
+	rule, ok := idempotentRules[method]
+	idempotentRulesMutex.RUnlock()
+
+	return ok && rule(biz)
+}
+
+//总是幂等.用于查询类接口
+func AlwaysIdempotent(biz interface{}) bool {
+	return true
+}
+
+//取业务参数中某个字符串字段的值.没有这个字段的返回空
+func bizField(biz interface{}, field string) string {
+	v := reflect.ValueOf(biz)
+	for v.Kind() == reflect.Ptr || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return ""
+	}
+
+	f := v.FieldByName(field)
+	if !f.IsValid() || f.Kind() != reflect.String {
+		return ""
+	}
+	return f.String()
+}
+
+//某个字段不为空时幂等.如 OrderReqNo RefundReqNo
+func IdempotentBy(field string) IdempotentRule {
+	return func(biz interface{}) bool {
+		return bizField(biz, field) != ""
+	}
+}
+
+//重试策略
+type RetryPolicy struct {
+	MaxAttempts int           //最多执行的次数(包括第一次).小于 1 的按 1 处理
+	BaseDelay   time.Duration //第一次重试前的等待时间.之后每次翻倍
+	MaxDelay    time.Duration //等待时间的上限.0 不限制
+	Jitter      float64       //随机抖动的比例 0~1.等待时间在 [delay*(1-Jitter), delay] 之间
+
+	//是否需要重试.为空时网络错误或者网关没有返回数据时重试
+	RetryOn func(err error, raw string) bool
+}
+
+//默认策略.最多 3 次.等待 200ms 400ms.抖动 50%
+func DefaultRetryPolicy() RetryPolicy {
+	return RetryPolicy{
+		MaxAttempts: 3,
+		BaseDelay:   200 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		Jitter:      0.5,
+	}
+}
+
+func defaultRetryOn(err error, raw string) bool {
+	//熔断或者限流的不重试
+	if _, ok := err.(*GuardError); ok {
+		return false
+	}
+	return err != nil || raw == ""
+}
+
+//第 attempt 次重试前的等待时间.attempt 从 1 开始
+func (p RetryPolicy) Backoff(attempt int) time.Duration {
+	if attempt < 1 || p.BaseDelay <= 0 {
+		return 0
+	}
+
+	delay := p.BaseDelay
+	for i := 1; i < attempt; i++ {
+		delay *= 2
+		if p.MaxDelay > 0 && delay >= p.MaxDelay {
+			break
+		}
+	}
+	if p.MaxDelay > 0 && delay > p.MaxDelay {
+		delay = p.MaxDelay
+	}
+
+	jitter := p.Jitter
+	if jitter > 1 {
+		jitter = 1
+	}
+	if jitter > 0 {
+		delay -= time.Duration(retryRand() * jitter * float64(delay))
+	}
+	return delay
+}
+
+//等待 d.ctx 结束时提前返回 ctx.Err()
+func sleepContext(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+//测试时替换
+var (
+	retrySleep = sleepContext
+	retryRand  = rand.Float64
+)
+
+//同 RunRetry.ctx 结束时停止重试.ctx 也会传给拦截器.只用于这一次执行.不影响 WithContext 设置的 ctx
+func (b *BestpayApi) RunRetryContext(ctx context.Context, p RetryPolicy) error {
+	return b.runRetry(ctx, p)
+}
+
+/**
+按策略执行.接口不幂等时只执行一次
+返回最后一次执行的错误.执行次数见 Attempts
+通过 WithContext 设置了 ctx 的.等待重试时 ctx 结束返回 ctx.Err()
+*/
+func (b *BestpayApi) RunRetry(p RetryPolicy) error {
+	return b.runRetry(b.runContext(), p)
+}
+
+func (b *BestpayApi) runRetry(ctx context.Context, p RetryPolicy) error {
+	max := p.MaxAttempts
+	if max < 1 {
+		max = 1
+	}
+	if !IsIdempotent(b.apimethod(), b.params) {
+		max = 1
+	}
+
+	retryOn := p.RetryOn
+	if retryOn == nil {
+		retryOn = defaultRetryOn
+	}
+
+	var err error
+	for attempt := 1; attempt <= max; attempt++ {
+		if attempt > 1 {
+			delay := p.Backoff(attempt - 1)
+			logs.Debug(fmt.Sprintf("==[retry]==[%s]==[%d]==[%v]", b.apiname(), attempt, delay))
+			if e := retrySleep(ctx, delay); e != nil {
+				return e
+			}
+		}
+
+		b.raw = ""
+		err = b.run(ctx)
+		b.attempts = attempt
+
+		if !retryOn(err, b.raw) {
+			break
+		}
+	}
+
+	return err
+}
+
+//签名 执行(按默认策略重试) 并解析 result
+func callApi(ctx context.Context, method string, biz bizInterface, key string, result interface{}) error {
+	api := GetApi(method)
+	if err := api.SetBizContentContext(ctx, biz, key); err != nil {
+		return err
+	}
+	if err := api.RunRetryContext(ctx, DefaultRetryPolicy()); err != nil {
+		return err
+	}
+	_, err := api.Response(result)
+	return err
+}
+
+//最近一次 Run 或者 RunRetry 的执行次数
+func (b *BestpayApi) Attempts() int {
+	return b.attempts
+}
+
+func init() {
+	for _, method := range []string{
+		BESTPAY_URL_QUERYORDER,
+		BESTPAY_URL_CLOSEORDER,
+		BESTPAY_URL_AGREEMENT_QUERY,
+		BESTPAY_URL_ACCOUNT_BALANCE,
+		BESTPAY_URL_ACCOUNT_SETTLEMENT,
+		BESTPAY_URL_LEDGER_QUERY,
+	} {
+		SetIdempotentRule(method, AlwaysIdempotent)
+	}
+
+	SetIdempotentRule(BESTPAY_URL_COMMONREFUND, IdempotentBy("RefundReqNo"))
+	SetIdempotentRule(BESTPAY_URL_REVERSE, IdempotentBy("RefundReqNo"))
+}
@@ -0,0 +1,148 @@
+package openbestpay
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+/**
+内存形式的订单存储
+进程重启之后数据丢失.用于测试或者单机的场景
+*/
+type MemoryOrderStore struct {
+	mutex   sync.RWMutex
+	orders  map[string]Order  //merchantId/orderNo
+	reqNos  map[string]string //merchantId/orderReqNo -> orderNo
+	refunds map[string]string //merchantId/refundReqNo -> orderNo
+}
+
+func NewMemoryOrderStore() *MemoryOrderStore {
+	return &MemoryOrderStore{
+		orders:  map[string]Order{},
+		reqNos:  map[string]string{},
+		refunds: map[string]string{},
+	}
+}
+
+func storeKey(merchantId, no string) string {
+	return merchantId + "/" + no
+}
+
+//复制一份.避免调用方修改 Refunds 影响存储中的数据
+func copyOrder(o Order) Order {
+	if o.Refunds != nil {
+		o.Refunds = append([]OrderRefund{}, o.Refunds...)
+	}
+	return o
+}
+
+func (s *MemoryOrderStore) Get(merchantId, orderNo string) (Order, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	o, ok := s.orders[storeKey(merchantId, orderNo)]
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return copyOrder(o), nil
+}
+
+func (s *MemoryOrderStore) GetByReqNo(merchantId, orderReqNo string) (Order, error) {
+	s.mutex.RLock()
+	orderNo, ok := s.reqNos[storeKey(merchantId, orderReqNo)]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return s.Get(merchantId, orderNo)
+}
+
+func (s *MemoryOrderStore) GetByRefundReqNo(merchantId, refundReqNo string) (Order, error) {
+	s.mutex.RLock()
+	orderNo, ok := s.refunds[storeKey(merchantId, refundReqNo)]
+	s.mutex.RUnlock()
+
+	if !ok {
+		return Order{}, ErrOrderNotFound
+	}
+	return s.Get(merchantId, orderNo)
+}
+
+func (s *MemoryOrderStore) Insert(o Order) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := storeKey(o.MerchantId, o.OrderNo)
+	if _, ok := s.orders[key]; ok {
+		return ErrOrderExists
+	}
+	if o.OrderReqNo != "" {
+		if _, ok := s.reqNos[storeKey(o.MerchantId, o.OrderReqNo)]; ok {
+			return ErrOrderExists
+		}
+		s.reqNos[storeKey(o.MerchantId, o.OrderReqNo)] = o.OrderNo
+	}
+
+	s.orders[key] = copyOrder(o)
+	s.indexRefunds(o)
+	return nil
+}
+
+func (s *MemoryOrderStore) Update(o Order) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	key := storeKey(o.MerchantId, o.OrderNo)
+	old, ok := s.orders[key]
+	if !ok {
+		return ErrOrderNotFound
+	}
+	if old.Version != o.Version-1 {
+		return ErrOrderConflict
+	}
+
+	//退款流水在商户下唯一.不能属于其它订单
+	for _, r := range o.Refunds {
+		if orderNo, ok := s.refunds[storeKey(o.MerchantId, r.RefundReqNo)]; ok && orderNo != o.OrderNo {
+			return ErrOrderExists
+		}
+	}
+
+	s.orders[key] = copyOrder(o)
+	s.indexRefunds(o)
+	return nil
+}
+
+func (s *MemoryOrderStore) indexRefunds(o Order) {
+	for _, r := range o.Refunds {
+		s.refunds[storeKey(o.MerchantId, r.RefundReqNo)] = o.OrderNo
+	}
+}
+
+//列出长时间没有变化的订单
+func (s *MemoryOrderStore) ListStale(states []string, before time.Time, limit int) ([]Order, error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+
+	want := map[string]bool{}
+	for _, state := range states {
+		want[state] = true
+	}
+
+	orders := []Order{}
+	for _, o := range s.orders {
+		if want[o.State] && o.UpdatedAt.Before(before) {
+			orders = append(orders, copyOrder(o))
+		}
+	}
+
+	sort.Slice(orders, func(i, j int) bool {
+		return orders[i].UpdatedAt.Before(orders[j].UpdatedAt)
+	})
+	if limit > 0 && len(orders) > limit {
+		orders = orders[:limit]
+	}
+	return orders, nil
+}
@@ -0,0 +1,381 @@
+package openbestpay
+
+import (
+	"bytes"
+	"database/sql"
+	"strconv"
+	"time"
+)
+
+/**
+database/sql 形式的订单存储.支持 SQLite Postgres MySQL
+驱动由调用方 import
+	db, _ := sql.Open("postgres", dsn)
+	store := NewSQLOrderStore(db, SQL_DIALECT_POSTGRES)
+	if err := store.Migrate(); err != nil { ... }
+表:
+	bestpay_orders             订单.主键 merchant_id+order_no.唯一 merchant_id+order_req_no.orderReqNo 为空时保存为 NULL
+	bestpay_refunds            退款.主键 merchant_id+refund_req_no
+	bestpay_schema_migrations  已经执行的迁移版本
+时间保存为 unix 纳秒.避免各个数据库时间类型的差异
+*/
+
+//数据库类型
+const (
+	SQL_DIALECT_SQLITE   = "sqlite"
+	SQL_DIALECT_POSTGRES = "postgres"
+	SQL_DIALECT_MYSQL    = "mysql"
+)
+
+//迁移.按版本顺序执行.已经发布的不能修改.只能追加
+var sqlOrderMigrations = [][]string{
+	1: {
+		`CREATE TABLE bestpay_orders (
+			merchant_id   VARCHAR(30) NOT NULL,
+			order_no      VARCHAR(30) NOT NULL,
+			order_req_no  VARCHAR(30),
+			order_date    VARCHAR(14) NOT NULL,
+			order_amt     BIGINT NOT NULL,
+			trans_amt     BIGINT NOT NULL,
+			coupon        BIGINT NOT NULL,
+			our_trans_no  VARCHAR(30) NOT NULL,
+			trans_status  VARCHAR(1) NOT NULL,
+			state         VARCHAR(20) NOT NULL,
+			version       BIGINT NOT NULL,
+			created_at    BIGINT NOT NULL,
+			updated_at    BIGINT NOT NULL,
+			PRIMARY KEY (merchant_id, order_no)
+		)`,
+		`CREATE UNIQUE INDEX bestpay_orders_req_no ON bestpay_orders (merchant_id, order_req_no)`,
+		`CREATE INDEX bestpay_orders_state ON bestpay_orders (state, updated_at)`,
+		`CREATE TABLE bestpay_refunds (
+			merchant_id    VARCHAR(30) NOT NULL,
+			refund_req_no  VARCHAR(30) NOT NULL,
+			order_no       VARCHAR(30) NOT NULL,
+			amount         BIGINT NOT NULL,
+			created_at     BIGINT NOT NULL,
+			PRIMARY KEY (merchant_id, refund_req_no)
+		)`,
+		`CREATE INDEX bestpay_refunds_order_no ON bestpay_refunds (merchant_id, order_no)`,
+	},
+}
+
+type SQLOrderStore struct {
+	db      *sql.DB
+	dialect string
+}
+
+func NewSQLOrderStore(db *sql.DB, dialect string) *SQLOrderStore {
+	return &SQLOrderStore{db: db, dialect: dialect}
+}
+
+//postgres 的占位符是 $1 $2.其它是 ?
+func (s *SQLOrderStore) rebind(query string) string {
+	if s.dialect != SQL_DIALECT_POSTGRES {
+		return query
+	}
+
+	var b bytes.Buffer
+	n := 0
+	for _, c := range query {
+		if c == '?' {
+			n++
+			b.WriteString("$" + strconv.Itoa(n))
+			continue
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+/**
+执行还没有执行的迁移.可以重复调用
+每个版本在一个事务中执行.MySQL 的 DDL 会隐式提交事务.失败时已经建好的表不会回滚.
+需要手动删除之后再执行
+*/
+func (s *SQLOrderStore) Migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS bestpay_schema_migrations (version BIGINT NOT NULL PRIMARY KEY)`); err != nil {
+		return err
+	}
+
+	current := 0
+	var v sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM bestpay_schema_migrations`).Scan(&v); err != nil {
+		return err
+	}
+	if v.Valid {
+		current = int(v.Int64)
+	}
+
+	for version := current + 1; version < len(sqlOrderMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlOrderMigrations[version] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return err
+			}
+		}
+		if _, err := tx.Exec(s.rebind(`INSERT INTO bestpay_schema_migrations (version) VALUES (?)`), version); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//当前的迁移版本
+func (s *SQLOrderStore) SchemaVersion() (int, error) {
+	var v sql.NullInt64
+	if err := s.db.QueryRow(`SELECT MAX(version) FROM bestpay_schema_migrations`).Scan(&v); err != nil {
+		return 0, err
+	}
+	return int(v.Int64), nil
+}
+
+const sqlOrderColumns = `merchant_id, order_no, order_req_no, order_date, order_amt, trans_amt, coupon, our_trans_no, trans_status, state, version, created_at, updated_at`
+
+func fromUnixNano(n int64) time.Time {
+	if n == 0 {
+		return time.Time{}
+	}
+	return time.Unix(0, n)
+}
+
+func toUnixNano(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.UnixNano()
+}
+
+func (s *SQLOrderStore) get(where string, args ...interface{}) (Order, error) {
+	o := Order{}
+	var orderReqNo sql.NullString
+	var createdAt, updatedAt int64
+
+	err := s.db.QueryRow(s.rebind(`SELECT `+sqlOrderColumns+` FROM bestpay_orders WHERE `+where), args...).Scan(
+		&o.MerchantId, &o.OrderNo, &orderReqNo, &o.OrderDate,
+		&o.OrderAmt, &o.TransAmt, &o.Coupon, &o.OurTransNo, &o.TransStatus,
+		&o.State, &o.Version, &createdAt, &updatedAt,
+	)
+	if err == sql.ErrNoRows {
+		return o, ErrOrderNotFound
+	} else if err != nil {
+		return o, err
+	}
+	o.OrderReqNo = orderReqNo.String
+	o.CreatedAt = fromUnixNano(createdAt)
+	o.UpdatedAt = fromUnixNano(updatedAt)
+
+	rows, err := s.db.Query(s.rebind(`SELECT refund_req_no, amount, created_at FROM bestpay_refunds WHERE merchant_id = ? AND order_no = ? ORDER BY created_at, refund_req_no`), o.MerchantId, o.OrderNo)
+	if err != nil {
+		return o, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		r := OrderRefund{}
+		var t int64
+		if err := rows.Scan(&r.RefundReqNo, &r.Amount, &t); err != nil {
+			return o, err
+		}
+		r.Time = fromUnixNano(t)
+		o.Refunds = append(o.Refunds, r)
+	}
+	return o, rows.Err()
+}
+
+func (s *SQLOrderStore) Get(merchantId, orderNo string) (Order, error) {
+	return s.get(`merchant_id = ? AND order_no = ?`, merchantId, orderNo)
+}
+
+func (s *SQLOrderStore) GetByReqNo(merchantId, orderReqNo string) (Order, error) {
+	return s.get(`merchant_id = ? AND order_req_no = ?`, merchantId, orderReqNo)
+}
+
+func (s *SQLOrderStore) GetByRefundReqNo(merchantId, refundReqNo string) (Order, error) {
+	var orderNo string
+	err := s.db.QueryRow(s.rebind(`SELECT order_no FROM bestpay_refunds WHERE merchant_id = ? AND refund_req_no = ?`), merchantId, refundReqNo).Scan(&orderNo)
+	if err == sql.ErrNoRows {
+		return Order{}, ErrOrderNotFound
+	} else if err != nil {
+		return Order{}, err
+	}
+	return s.Get(merchantId, orderNo)
+}
+
+//写入还没有保存的退款
+func (s *SQLOrderStore) insertRefunds(tx *sql.Tx, o Order) error {
+	saved := map[string]bool{}
+	rows, err := tx.Query(s.rebind(`SELECT refund_req_no FROM bestpay_refunds WHERE merchant_id = ? AND order_no = ?`), o.MerchantId, o.OrderNo)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var no string
+		if err := rows.Scan(&no); err != nil {
+			rows.Close()
+			return err
+		}
+		saved[no] = true
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, r := range o.Refunds {
+		if saved[r.RefundReqNo] {
+			continue
+		}
+
+		var n int
+		if err := tx.QueryRow(s.rebind(`SELECT COUNT(*) FROM bestpay_refunds WHERE merchant_id = ? AND refund_req_no = ?`), o.MerchantId, r.RefundReqNo).Scan(&n); err != nil {
+			return err
+		}
+		if n > 0 {
+			return ErrOrderExists
+		}
+
+		if _, err := tx.Exec(s.rebind(`INSERT INTO bestpay_refunds (merchant_id, refund_req_no, order_no, amount, created_at) VALUES (?, ?, ?, ?, ?)`),
+			o.MerchantId, r.RefundReqNo, o.OrderNo, r.Amount, toUnixNano(r.Time)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *SQLOrderStore) Insert(o Order) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	//orderReqNo 为空的不参与唯一检查.与 MemoryOrderStore 一致
+	query := `SELECT COUNT(*) FROM bestpay_orders WHERE merchant_id = ? AND order_no = ?`
+	args := []interface{}{o.MerchantId, o.OrderNo}
+	orderReqNo := sql.NullString{String: o.OrderReqNo, Valid: o.OrderReqNo != ""}
+	if orderReqNo.Valid {
+		query = `SELECT COUNT(*) FROM bestpay_orders WHERE merchant_id = ? AND (order_no = ? OR order_req_no = ?)`
+		args = append(args, o.OrderReqNo)
+	}
+
+	var n int
+	if err := tx.QueryRow(s.rebind(query), args...).Scan(&n); err != nil {
+		return err
+	}
+	if n > 0 {
+		return ErrOrderExists
+	}
+
+	if _, err := tx.Exec(s.rebind(`INSERT INTO bestpay_orders (`+sqlOrderColumns+`) VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`),
+		o.MerchantId, o.OrderNo, orderReqNo, o.OrderDate,
+		o.OrderAmt, o.TransAmt, o.Coupon, o.OurTransNo, o.TransStatus,
+		o.State, o.Version, toUnixNano(o.CreatedAt), toUnixNano(o.UpdatedAt)); err != nil {
+		return err
+	}
+
+	if err := s.insertRefunds(tx, o); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//乐观锁.只有版本为 o.Version-1 的才会更新
+func (s *SQLOrderStore) Update(o Order) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(s.rebind(`UPDATE bestpay_orders SET order_amt = ?, trans_amt = ?, coupon = ?, our_trans_no = ?, trans_status = ?, state = ?, version = ?, updated_at = ? WHERE merchant_id = ? AND order_no = ? AND version = ?`),
+		o.OrderAmt, o.TransAmt, o.Coupon, o.OurTransNo, o.TransStatus, o.State, o.Version, toUnixNano(o.UpdatedAt),
+		o.MerchantId, o.OrderNo, o.Version-1)
+	if err != nil {
+		return err
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return err
+	}
+	if n == 0 {
+		var count int
+		if err := tx.QueryRow(s.rebind(`SELECT COUNT(*) FROM bestpay_orders WHERE merchant_id = ? AND order_no = ?`), o.MerchantId, o.OrderNo).Scan(&count); err != nil {
+			return err
+		}
+		if count == 0 {
+			return ErrOrderNotFound
+		}
+		return ErrOrderConflict
+	}
+
+	if err := s.insertRefunds(tx, o); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+//列出长时间没有变化的订单
+func (s *SQLOrderStore) ListStale(states []string, before time.Time, limit int) ([]Order, error) {
+	if len(states) == 0 {
+		return nil, nil
+	}
+
+	args := []interface{}{}
+	in := ""
+	for i, state := range states {
+		if i > 0 {
+			in += ", "
+		}
+		in += "?"
+		args = append(args, state)
+	}
+	args = append(args, toUnixNano(before))
+
+	query := `SELECT merchant_id, order_no FROM bestpay_orders WHERE state IN (` + in + `) AND updated_at < ? ORDER BY updated_at`
+	//limit <= 0 不限制
+	if limit > 0 {
+		query += ` LIMIT ?`
+		args = append(args, limit)
+	}
+	rows, err := s.db.Query(s.rebind(query), args...)
+	if err != nil {
+		return nil, err
+	}
+
+	type key struct{ merchantId, orderNo string }
+	keys := []key{}
+	for rows.Next() {
+		k := key{}
+		if err := rows.Scan(&k.merchantId, &k.orderNo); err != nil {
+			rows.Close()
+			return nil, err
+		}
+		keys = append(keys, k)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	orders := []Order{}
+	for _, k := range keys {
+		o, err := s.Get(k.merchantId, k.orderNo)
+		if err == ErrOrderNotFound {
+			continue
+		} else if err != nil {
+			return nil, err
+		}
+		orders = append(orders, o)
+	}
+	return orders, nil
+}
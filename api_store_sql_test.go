@@ -0,0 +1,93 @@
+//go:build sqlite
+// +build sqlite
+
+package openbestpay
+
+/**
+SQLOrderStore 的测试需要 sqlite 驱动(cgo).核心包不依赖它.单独执行:
+	go test -tags sqlite -run Test_sql_order_store
+*/
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+
+	_ "github.com/mattn/go-sqlite3"
+)
+
+//测试 database/sql 订单存储
+func Test_sql_order_store(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	//:memory: 每个连接是一个单独的库
+	db.SetMaxOpenConns(1)
+
+	s := NewSQLOrderStore(db, SQL_DIALECT_SQLITE)
+	for i := 0; i < 2; i++ {
+		if err := s.Migrate(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if v, err := s.SchemaVersion(); err != nil || v != len(sqlOrderMigrations)-1 {
+		t.Errorf("迁移版本错误 %v %d", err, v)
+	}
+
+	now := time.Date(2017, 9, 1, 0, 0, 0, 0, time.Local)
+	o := Order{MerchantId: "043101180050000", OrderNo: "14337346095601", OrderReqNo: "14337346095602", OrderAmt: 100, State: ORDER_CREATED, Version: 1, CreatedAt: now, UpdatedAt: now}
+	if err := s.Insert(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Insert(Order{MerchantId: o.MerchantId, OrderNo: "14337346095603", OrderReqNo: o.OrderReqNo}); err != ErrOrderExists {
+		t.Errorf("orderReqNo 重复 应该返回 ErrOrderExists %v", err)
+	}
+
+	//orderReqNo 为空的可以有多个
+	for _, no := range []string{"14337346095605", "14337346095607"} {
+		if err := s.Insert(Order{MerchantId: o.MerchantId, OrderNo: no, State: ORDER_PAYING, Version: 1, UpdatedAt: now.Add(time.Minute)}); err != nil {
+			t.Errorf("orderReqNo 为空 应该可以保存 %v", err)
+		}
+	}
+	if v, err := s.Get(o.MerchantId, "14337346095605"); err != nil || v.OrderReqNo != "" {
+		t.Errorf("读取 orderReqNo 为空的订单错误 %v %+v", err, v)
+	}
+
+	o.Version = 2
+	o.State = ORDER_PAID
+	o.Refunds = []OrderRefund{{RefundReqNo: "R1", Amount: 10, Time: now}}
+	if err := s.Update(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(o); err != ErrOrderConflict {
+		t.Errorf("版本相同 应该返回 ErrOrderConflict %v", err)
+	}
+	if err := s.Update(Order{MerchantId: o.MerchantId, OrderNo: "none", Version: 2}); err != ErrOrderNotFound {
+		t.Errorf("订单不存在 应该返回 ErrOrderNotFound %v", err)
+	}
+
+	if v, err := s.GetByReqNo(o.MerchantId, o.OrderReqNo); err != nil || v.Version != 2 || v.State != ORDER_PAID || !v.UpdatedAt.Equal(now) {
+		t.Errorf("按 orderReqNo 查找错误 %v %+v", err, v)
+	}
+	if v, err := s.GetByRefundReqNo(o.MerchantId, "R1"); err != nil || v.RefundedAmt() != 10 {
+		t.Errorf("按 refundReqNo 查找错误 %v %+v", err, v)
+	}
+}
+
+//测试 database/sql 订单存储 ListStale.与 MemoryOrderStore 一致
+func Test_sql_order_store_list_stale(t *testing.T) {
+	db, err := sql.Open("sqlite3", ":memory:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	db.SetMaxOpenConns(1)
+
+	s := NewSQLOrderStore(db, SQL_DIALECT_SQLITE)
+	if err := s.Migrate(); err != nil {
+		t.Fatal(err)
+	}
+	checkListStale(t, s)
+}
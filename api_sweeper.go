@@ -0,0 +1,255 @@
+package openbestpay
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/liteck/logs"
+	"github.com/liteck/tools"
+)
+
+/**
+未支付订单清理
+付款码支付返回 transStatus=A 之后.用户可能一直没有输入密码.或者下单时网络超时不知道结果
+这些订单需要跟进.否则可能出现用户已经扣款.商户却认为没有支付的情况
+	s := NewExpirySweeper(store, key, merchantPwd)
+	s.Expiry = 5 * time.Minute
+	s.IsLeader = func(ctx context.Context) bool { return lock.Held() } //多实例部署时只让一个实例执行
+	go s.Run(ctx)
+	...
+	cancel() //处理完当前订单之后退出
+每一轮:
+	1.从 OrderStore 找出超过 Expiry 没有变化的 created/paying 订单
+	2.交易查询.已经成功或者失败的更新状态即可
+	3.仍然未支付的撤单(默认)或者关闭订单
+OrderStore 需要实现 StaleOrderLister.MemoryOrderStore 和 SQLOrderStore 都已经实现
+查询 关闭 撤单都需要 orderReqNo.没有 orderReqNo 的订单跳过(SWEEP_SKIPPED).需要人工处理
+*/
+
+//可以列出长时间没有变化的订单
+type StaleOrderLister interface {
+	//状态为 states 之一.并且 UpdatedAt 早于 before 的订单.按 UpdatedAt 从早到晚.最多 limit 条.limit <= 0 不限制
+	ListStale(states []string, before time.Time, limit int) ([]Order, error)
+}
+
+//未支付订单的处理方式
+const (
+	SWEEP_ACTION_REVERSE = "reverse" //撤单.付款码支付使用
+	SWEEP_ACTION_CLOSE   = "close"   //关闭订单.二维码 H5 等使用
+)
+
+//一笔订单的处理结果
+const (
+	SWEEP_RESOLVED = "resolved" //查询之后已经有结果.只更新了状态
+	SWEEP_REVERSED = "reversed" //已撤单
+	SWEEP_CLOSED   = "closed"   //已关闭
+	SWEEP_FAILED   = "failed"   //处理失败.下一轮重试
+	SWEEP_SKIPPED  = "skipped"  //没有 orderReqNo.不能查询和撤单
+)
+
+type SweepResult struct {
+	Order  Order  //处理之后的订单
+	Result string //SWEEP_*
+	Err    error
+}
+
+type ExpirySweeper struct {
+	Store       OrderStore
+	Key         string        //商户秘钥
+	MerchantPwd string        //撤单时使用
+	Expiry      time.Duration //超过多久没有支付的需要处理.默认 5 分钟
+	Interval    time.Duration //扫描间隔.默认 1 分钟
+	Batch       int           //每一轮最多处理的订单数.默认 100
+	Action      string        //SWEEP_ACTION_*.默认撤单
+	Timeout     time.Duration //每一笔订单的查询 关闭 撤单的超时.默认 1 分钟
+
+	//是否是 leader.为空时总是执行.每一轮和每一笔订单之前都会检查
+	IsLeader func(ctx context.Context) bool
+	//每一笔订单处理之后回调.用于监控或者告警
+	OnResult func(r SweepResult)
+
+	call func(ctx context.Context, method string, biz bizInterface, key string, result interface{}) error
+}
+
+func NewExpirySweeper(store OrderStore, key, merchantPwd string) *ExpirySweeper {
+	return &ExpirySweeper{
+		Store:       store,
+		Key:         key,
+		MerchantPwd: merchantPwd,
+		Expiry:      5 * time.Minute,
+		Interval:    time.Minute,
+		Batch:       100,
+		Action:      SWEEP_ACTION_REVERSE,
+		Timeout:     time.Minute,
+		call:        callApi,
+	}
+}
+
+func (s *ExpirySweeper) leader(ctx context.Context) bool {
+	return s.IsLeader == nil || s.IsLeader(ctx)
+}
+
+/**
+按 Interval 执行直到 ctx 结束
+ctx 只在每一轮和每一笔订单之前检查.ctx 结束之后不再处理新的订单
+正在处理的订单执行完(最多 Timeout)之后退出.返回 nil
+*/
+func (s *ExpirySweeper) Run(ctx context.Context) error {
+	interval := s.Interval
+	if interval <= 0 {
+		interval = time.Minute
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		if _, err := s.SweepOnce(ctx); err != nil {
+			logs.Error("==[sweeper]==", err.Error())
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+/**
+执行一轮.不是 leader 的直接返回
+每一笔订单的请求不使用 ctx.撤单 关闭中途取消的话结果不确定.超时见 Timeout
+*/
+func (s *ExpirySweeper) SweepOnce(ctx context.Context) ([]SweepResult, error) {
+	if !s.leader(ctx) {
+		return nil, nil
+	}
+
+	lister, ok := s.Store.(StaleOrderLister)
+	if !ok {
+		return nil, msgError(MSG_STORE_NO_STALE)
+	}
+
+	expiry := s.Expiry
+	if expiry <= 0 {
+		expiry = 5 * time.Minute
+	}
+	batch := s.Batch
+	if batch <= 0 {
+		batch = 100
+	}
+
+	orders, err := lister.ListStale([]string{ORDER_CREATED, ORDER_PAYING}, orderNow().Add(-expiry), batch)
+	if err != nil {
+		return nil, err
+	}
+
+	results := []SweepResult{}
+	for _, o := range orders {
+		if ctx.Err() != nil || !s.leader(ctx) {
+			break
+		}
+
+		r := s.sweepTimeout(o)
+		if r.Err != nil {
+			logs.Error("==[sweeper]==", o.MerchantId, o.OrderNo, r.Err.Error())
+		}
+		if s.OnResult != nil {
+			s.OnResult(r)
+		}
+		results = append(results, r)
+	}
+	return results, nil
+}
+
+/**
+撤单流水.同一个订单每次都一样.重复执行时网关按 refundReqNo 去重
+refundReqNo 最长 30 位并且是偶数位.用 RV + orderNo 的 MD5 前 28 位
+*/
+func sweepRefundReqNo(o Order) string {
+	return "RV" + strings.ToUpper(tools.MD5(o.MerchantId + "/" + o.OrderNo))[:28]
+}
+
+//处理一笔订单.使用单独的 ctx.不受 Run 的 ctx 影响
+func (s *ExpirySweeper) sweepTimeout(o Order) SweepResult {
+	timeout := s.Timeout
+	if timeout <= 0 {
+		timeout = time.Minute
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return s.sweep(ctx, o)
+}
+
+//处理一笔订单
+func (s *ExpirySweeper) sweep(ctx context.Context, o Order) SweepResult {
+	if o.OrderReqNo == "" {
+		return SweepResult{Order: o, Result: SWEEP_SKIPPED, Err: msgError(MSG_FIELD_NIL, "orderReqNo")}
+	}
+
+	call := s.call
+	if call == nil {
+		call = callApi
+	}
+	m := NewOrderMachine(s.Store)
+
+	query := Biz_bestpay_queryorder{
+		MerchantId: o.MerchantId,
+		OrderNo:    o.OrderNo,
+		OrderReqNo: o.OrderReqNo,
+		OrderDate:  o.OrderDate,
+	}
+
+	q := Resp_bestpay_queryorder{}
+	if err := call(ctx, BESTPAY_URL_QUERYORDER, query, s.Key, &q); err != nil {
+		//下单时网络超时的订单网关可能不存在.查询失败也继续处理
+		//支付中的订单网关一定存在.查询失败是临时的.下一轮再查
+		if o.State != ORDER_CREATED {
+			return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+		}
+	} else if q.TransStatus != "" {
+		v, err := m.Apply(o.MerchantId, o.OrderNo, EventFromQueryOrder(q))
+		if err != nil {
+			return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+		}
+		if o = v; o.State != ORDER_CREATED && o.State != ORDER_PAYING {
+			return SweepResult{Order: o, Result: SWEEP_RESOLVED}
+		}
+	}
+
+	if s.Action == SWEEP_ACTION_CLOSE {
+		r := Resp_bestpay_closeorder{}
+		if err := call(ctx, BESTPAY_URL_CLOSEORDER, query.CloseOrder(), s.Key, &r); err != nil {
+			return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+		}
+		v, err := m.Apply(o.MerchantId, o.OrderNo, EventFromCloseOrder(r))
+		if err != nil {
+			return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+		}
+		return SweepResult{Order: v, Result: SWEEP_CLOSED}
+	}
+
+	amt := o.TransAmt
+	if amt == 0 {
+		amt = o.OrderAmt
+	}
+	reverse := Biz_bestpay_reverse{
+		MerchantId:    o.MerchantId,
+		MerchantPwd:   s.MerchantPwd,
+		OldOrderNo:    o.OrderNo,
+		OldOrderReqNo: o.OrderReqNo,
+		RefundReqNo:   sweepRefundReqNo(o),
+		RefundReqDate: orderNow().Format("20060102"),
+		TransAmt:      amt,
+	}
+	r := Resp_bestpay_reverse{}
+	if err := call(ctx, BESTPAY_URL_REVERSE, reverse, s.Key, &r); err != nil {
+		return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+	}
+	v, err := m.Apply(o.MerchantId, o.OrderNo, EventFromReverse(r))
+	if err != nil {
+		return SweepResult{Order: o, Result: SWEEP_FAILED, Err: err}
+	}
+	return SweepResult{Order: v, Result: SWEEP_REVERSED}
+}
@@ -1,7 +1,19 @@
 package openbestpay
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/liteck/logs"
 )
@@ -58,3 +70,1780 @@ func Test_bestpay_commonrefund(t *testing.T) {
 
 	api.Run()
 }
+
+//测试 商品详情
+func Test_goodsdetail(t *testing.T) {
+	biz := Biz_bestpay_barcode_placeorder{
+		MerchantId: "043101180050000",
+		Barcode:    "515665002854886972",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   300,
+		ProductAmt: 300,
+		StoreId:    "201231",
+	}
+	biz.AddGoodsDetail(
+		NewGoodsDetailItem("1001", "可乐", 2, 100),
+		NewGoodsDetailItem("1002", "雪碧", 1, 100).SetCategory("饮料"),
+	)
+
+	if err := biz.valid(); err != nil {
+		t.Error(err)
+	}
+
+	if err := biz.ValidGoodsDetailAmt(); err != nil {
+		t.Error(err)
+	}
+
+	biz.ProductAmt, biz.OrderAmt = 200, 200
+	if err := biz.ValidGoodsDetailAmt(); err == nil {
+		t.Error("productAmt 与商品详情合计不一致 应该返回错误")
+	}
+
+	biz.AddGoodsDetail(GoodsDetailItem{GoodsName: "没有编号"})
+	if err := biz.valid(); err == nil {
+		t.Error("goodsId 为空 应该返回错误")
+	}
+}
+
+//测试 校验错误一次返回所有字段
+func Test_validationerror(t *testing.T) {
+	err := Biz_bestpay_queryorder{
+		OrderNo:    "123",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "2015-06-08",
+	}.valid()
+
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("应该返回 *ValidationError 实际为 %T", err)
+	}
+
+	for _, field := range []string{"merchantId", "orderNo", "orderDate"} {
+		if !ve.Has(field) {
+			t.Errorf("%s 应该校验失败: %s", field, ve.Error())
+		}
+	}
+
+	if ve.Has("orderReqNo") {
+		t.Errorf("orderReqNo 不应该校验失败: %s", ve.Error())
+	}
+}
+
+//测试 合并非 ValidationError 以及序列化失败 使用 format 规则
+func Test_validation_format(t *testing.T) {
+	ve := &ValidationError{}
+	ve.merge("ledgerDetail", errors.New("bad"))
+	if len(ve.Fields) != 1 || ve.Fields[0].Rule != RULE_FORMAT {
+		t.Errorf("非 ValidationError 应该是 format 规则: %+v", ve.Fields)
+	}
+
+	ve = validStruct(struct {
+		Detail map[string]interface{} `bestpay:"max=10"`
+	}{map[string]interface{}{"a": func() {}}})
+	if len(ve.Fields) != 1 || ve.Fields[0].Rule != RULE_FORMAT {
+		t.Errorf("序列化失败 应该是 format 规则: %+v", ve.Fields)
+	}
+}
+
+//测试 写错的 tag 直接 panic
+func Test_validation_bad_tag(t *testing.T) {
+	for _, v := range []interface{}{
+		struct {
+			A string `bestpay:"max=abc"`
+		}{"x"},
+		struct {
+			A int `bestpay:"min="`
+		}{1},
+		struct {
+			A string `bestpay:"required,maxlen=10"`
+		}{"x"},
+	} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Errorf("%T 应该 panic", v)
+				}
+			}()
+			validStruct(v)
+		}()
+	}
+}
+
+//测试 元转为分
+func Test_yuan_to_fen(t *testing.T) {
+	for s, want := range map[string]int{"0.01": 1, "1": 100, "1.5": 150, "12.34": 1234, "0": 0} {
+		if fen, err := yuanToFen(s); err != nil || fen != want {
+			t.Errorf("%s 应该是 %d 分 实际为 %d %v", s, want, fen, err)
+		}
+	}
+	for _, s := range []string{"", ".5", "1.", "0.001", "-1", "+1", "1,00", "a"} {
+		if _, err := yuanToFen(s); err == nil {
+			t.Errorf("%s 应该返回错误", s)
+		}
+	}
+}
+
+//测试 多语言提示信息
+func Test_i18n(t *testing.T) {
+	defer SetLang(LANG_ZH)
+
+	if err := SetLang("fr"); err == nil || err.Error() != "不支持的语言 fr" {
+		t.Errorf("不支持的语言 应该返回错误 %v", err)
+	}
+	if Message(LANG_ZH, MSG_ORDER_AMT_SUM) == Message(LANG_EN, MSG_ORDER_AMT_SUM) {
+		t.Error("orderAmt 合计的中文提示没有翻译")
+	}
+
+	err := Biz_bestpay_queryorder{}.valid()
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		t.Fatalf("应该返回 *ValidationError 实际为 %T", err)
+	}
+	if msg := ve.Fields[0].Msg; msg != CAN_NOT_NIL {
+		t.Errorf("默认语言应该是中文 实际为 %s", msg)
+	}
+	if msg := ve.Localize(LANG_EN)[0].Msg; msg != "can not be empty" {
+		t.Errorf("英文提示不正确 %s", msg)
+	}
+
+	if err := SetLang(LANG_EN); err != nil {
+		t.Fatal(err)
+	}
+	if bid := GetBankId("EPAYACC"); bid.Desc != "Bestpay account" {
+		t.Errorf("英文 BankId 说明不正确 %s", bid.Desc)
+	}
+	if bid := GetBankIdLang("EPAYACC", LANG_ZH); bid.Desc != "翼支付账户" {
+		t.Errorf("中文 BankId 说明不正确 %s", bid.Desc)
+	}
+	if _, err := ParsePayChannel("", 0); err == nil || err.Error() != "payChannel can not be empty" {
+		t.Errorf("英文错误提示不正确 %v", err)
+	}
+	if ErrOrderNotFound.Error() != "order not found" {
+		t.Errorf("ErrOrderNotFound 应该按当前语言 %s", ErrOrderNotFound)
+	}
+
+	RegisterMessages(LANG_EN, map[string]string{MSG_GATEWAY_ERROR_PREFIX + "E001": "order not found"})
+	if m := (Response{ErrorCode: "E001", ErrorMsg: "订单不存在"}).Message(LANG_EN); m != "order not found" {
+		t.Errorf("网关错误提示不正确 %s", m)
+	}
+	if m := (Response{ErrorCode: "E002", ErrorMsg: "其它错误"}).Message(LANG_EN); m != "其它错误" {
+		t.Errorf("没有注册的错误码应该使用网关返回的 errorMsg %s", m)
+	}
+}
+
+//测试 bankid 目录
+func Test_bankid(t *testing.T) {
+	defer ResetBankIdCatalog()
+
+	if bid := GetBankIdLang("ICBC_Q", LANG_ZH); bid.Channel != BANK_CHANNEL_QUICK || bid.BankName != "中国工商银行" {
+		t.Errorf("ICBC_Q 解析不正确 %+v", bid)
+	}
+	if bid := GetBankIdLang("CMB_C", LANG_EN); bid.Channel != BANK_CHANNEL_B2C || bid.CardType != CARD_TYPE_CREDIT || bid.BankName != "China Merchants Bank" {
+		t.Errorf("CMB_C 解析不正确 %+v", bid)
+	}
+	if bid := GetBankIdLang("VOUCHER_3AC", LANG_ZH); bid.Channel != BANK_CHANNEL_BALANCE || bid.Desc != "营销代金券" {
+		t.Errorf("VOUCHER_3AC 解析不正确 %+v", bid)
+	}
+	if bid := GetBankIdLang("XXX", LANG_ZH); bid.Channel != BANK_CHANNEL_NONE || bid.Desc != "无此信息" {
+		t.Errorf("未知 bankid 解析不正确 %+v", bid)
+	}
+
+	SetBank(Bank{Code: "XXB", Name: map[string]string{LANG_ZH: "测试银行"}})
+	if name := BankName("XXB_B2C", LANG_EN); name != "测试银行" {
+		t.Errorf("补充的银行没有生效 %s", name)
+	}
+
+	if err := LoadBankIdCatalog(strings.NewReader(`{"accounts":[]}`)); err == nil {
+		t.Error("没有版本号的目录 应该返回错误")
+	}
+	if err := LoadBankIdCatalog(strings.NewReader(`{"version":"test","accounts":[{"bankId":"X","channel":"foo"}]}`)); err == nil {
+		t.Error("未知渠道类别的账户 应该返回错误")
+	}
+	if err := LoadBankIdCatalog(strings.NewReader(`{"version":"test","suffixes":[{"suffix":"_X","channel":""}]}`)); err == nil {
+		t.Error("未知渠道类别的后缀 应该返回错误")
+	}
+	if err := SetBankIdAccount(BankIdAccount{BankId: "X", Channel: "foo"}); err == nil {
+		t.Error("未知渠道类别的账户 应该返回错误")
+	}
+	if err := LoadBankIdCatalog(strings.NewReader(`{"version":"test","accounts":[{"bankId":"EPAYACC","channel":"balance"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if v := BankIdCatalogVersion(); v != "test" {
+		t.Errorf("目录版本不正确 %s", v)
+	}
+	if bid := GetBankIdLang("EPAYACC", LANG_ZH); bid.Desc != "个账余额类型" {
+		t.Errorf("没有名称的账户应该使用类别说明 %+v", bid)
+	}
+}
+
+//测试 付款明细解析
+func Test_paychannel(t *testing.T) {
+	resp := Resp_bestpay_queryorder{
+		TransAmt:   1000,
+		PayChannel: "ICBC_Q:700|VOUCHER_3AC:200|COMPANYACC_3AC:100",
+	}
+	detail, err := resp.PayChannelDetail()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(detail.Legs); n != 3 {
+		t.Fatalf("应该有 3 项 实际为 %d", n)
+	}
+	if v := detail.Amount(FUND_TYPE_QUICK); v != 700 {
+		t.Errorf("快捷支付金额不正确 %d", v)
+	}
+	if v := detail.CouponAmt(); v != 300 {
+		t.Errorf("优惠金额不正确 %d", v)
+	}
+	if v := detail.RealAmt(); v != 700 {
+		t.Errorf("实际支付金额不正确 %d", v)
+	}
+	if name := detail.Legs[0].BankId.BankCode; name != "ICBC" {
+		t.Errorf("银行编码不正确 %s", name)
+	}
+
+	detail, err = ParsePayChannel("EPAYACC", 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if leg := detail.Legs[0]; leg.FundType != FUND_TYPE_BALANCE || leg.Amount != 500 {
+		t.Errorf("只有 bankId 的付款明细解析不正确 %+v", leg)
+	}
+
+	if _, err := ParsePayChannel("EPAYACC|VOUCHER_3AC", 500); err == nil {
+		t.Error("多项没有金额 应该返回错误")
+	}
+	if _, err := ParsePayChannel("EPAYACC:400|VOUCHER_3AC:50", 500); err == nil {
+		t.Error("合计金额与交易金额不一致 应该返回错误")
+	}
+	if _, err := ParsePayChannel("EPAYACC:abc", 500); err == nil {
+		t.Error("金额格式错误 应该返回错误")
+	}
+}
+
+//测试 二维码支付 以及响应解析
+func Test_bestpay_qrcode_placeorder(t *testing.T) {
+	api := GetApi(BESTPAY_URL_QRCODE_PLACEORDER)
+	if err := api.SetBizContent(Biz_bestpay_qrcode_placeorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   1,
+		ProductAmt: 1,
+		StoreId:    "201231",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	api.raw = `{"success":true,"result":{"orderNo":"14337346095601","transAmt":"1","codeUrl":"https://qr.bestpay.com.cn/x"}}`
+	var result Resp_bestpay_qrcode_placeorder
+	if _, err := api.Response(&result); err != nil {
+		t.Fatal(err)
+	}
+	if result.CodeUrl != "https://qr.bestpay.com.cn/x" || result.TransAmt != 1 {
+		t.Errorf("响应解析不正确 %+v", result)
+	}
+
+	api.raw = `{"success":"false","errorCode":"E001","errorMsg":"订单重复"}`
+	if resp, err := api.Response(&result); err == nil || resp.ErrorCode != "E001" {
+		t.Errorf("网关返回失败 应该返回错误 %+v", resp)
+	}
+
+	api.raw = `{"success":false}`
+	if _, err := api.Response(&result); err == nil || err.Error() != "网关返回错误 success=false" {
+		t.Errorf("没有错误码和错误信息 也不能返回空的错误 %v", err)
+	}
+}
+
+//测试 H5 收银台跳转
+func Test_bestpay_h5_cashier(t *testing.T) {
+	api := GetApi(BESTPAY_URL_H5_CASHIER)
+	if _, err := api.HtmlForm(); err == nil {
+		t.Error("没有设置业务参数 应该返回错误")
+	}
+
+	if err := api.SetBizContent(Biz_bestpay_h5_cashier{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   1,
+		GoodsName:  `"可乐"`,
+		PageUrl:    "https://shop.example.com/paid?id=1",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+
+	link, err := api.RedirectUrl()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(link, BESTPAY_URL_H5_CASHIER+"?") || !strings.Contains(link, "mac="+api.mac()) {
+		t.Errorf("跳转链接不正确 %s", link)
+	}
+	if !strings.Contains(link, "orderNo=14337346095601") {
+		t.Errorf("跳转链接应该使用接口参数名 %s", link)
+	}
+
+	form, err := api.HtmlForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(form, `name="goodsName" value="&#34;可乐&#34;"`) {
+		t.Errorf("表单没有转义 %s", form)
+	}
+	if !strings.Contains(form, `name="mac" value="`+api.mac()+`"`) {
+		t.Errorf("表单缺少签名 %s", form)
+	}
+}
+
+//测试 App sdk 订单信息
+func Test_app_orderinfo(t *testing.T) {
+	biz := Biz_bestpay_app_orderinfo{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   100,
+		GoodsName:  "可乐",
+		CustomerId: "0",
+		Attach:     "a&b=0",
+	}
+
+	info, err := AppOrderInfo(biz, "1")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	api := BestpayApi{Key: "1", params: biz}
+	want := "merchantId=043101180050000&orderNo=14337346095601&orderReqNo=14337346095601&orderDate=20150608113649&orderAmt=100&goodsName=%E5%8F%AF%E4%B9%90&customerId=0&attach=a%26b%3D0&mac=" + api.mac()
+	if info != want {
+		t.Errorf("订单信息不正确\n%s\n%s", info, want)
+	}
+
+	if _, err := AppOrderInfo(biz, ""); err == nil {
+		t.Error("key 为空 应该返回错误")
+	}
+}
+
+//测试 网关支付 bankId 校验
+func Test_bestpay_gateway_pay(t *testing.T) {
+	biz := Biz_bestpay_gateway_pay{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   1,
+		ProductAmt: 1,
+		PageUrl:    "https://shop.example.com/paid",
+	}
+
+	for _, bankid := range []string{"", "ICBC_B2C", "CCB_B2B", "CMB_Q"} {
+		biz.BankId = bankid
+		if err := biz.valid(); err != nil {
+			t.Errorf("%s 应该可以用于网关支付 %s", bankid, err)
+		}
+	}
+
+	for _, bankid := range []string{"EPAYACC", "UNKNOWN", "NOBANK_B2C"} {
+		biz.BankId = bankid
+		err := biz.valid()
+		if ve, ok := err.(*ValidationError); !ok || !ve.Has("bankId") {
+			t.Errorf("%s 不能用于网关支付", bankid)
+		}
+	}
+
+	biz.BankId = "ICBC_B2C"
+	api := GetApi(BESTPAY_URL_GATEWAY_PAY)
+	if err := api.SetBizContent(biz, "1"); err != nil {
+		t.Fatal(err)
+	}
+	form, err := api.HtmlForm()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(form, `action="`+BESTPAY_URL_GATEWAY_PAY+`"`) || !strings.Contains(form, `name="bankId" value="ICBC_B2C"`) {
+		t.Errorf("网关支付表单不正确 %s", form)
+	}
+	if !strings.Contains(form, `name="busiType" value="0000001"`) {
+		t.Errorf("busiType 应该使用默认值 %s", form)
+	}
+
+	//修改返回的副本不影响校验
+	channels := GatewayBankChannels()
+	channels[0] = BANK_CHANNEL_BALANCE
+	biz.BankId = "EPAYACC"
+	if err := biz.valid(); err == nil {
+		t.Error("修改 GatewayBankChannels 的返回值不应该影响校验")
+	}
+}
+
+//测试 订单关闭
+func Test_bestpay_closeorder(t *testing.T) {
+	query := Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}
+
+	api := GetApi(BESTPAY_URL_CLOSEORDER)
+	if err := api.SetBizContent(query.CloseOrder(), "1"); err != nil {
+		t.Fatal(err)
+	}
+	if tobe := api.params.tobe_mac(); tobe != query.tobe_mac() {
+		t.Errorf("关闭订单的签名串应该与交易查询一致 %s", tobe)
+	}
+
+	api.Run()
+}
+
+//测试 委托代扣
+func Test_bestpay_agreement(t *testing.T) {
+	if err := (Biz_bestpay_agreement_query{MerchantId: "043101180050000"}).valid(); err == nil {
+		t.Error("agreementNo 和 agreementReqNo 都为空 应该返回错误")
+	}
+	if err := (Biz_bestpay_agreement_query{MerchantId: "043101180050000", AgreementNo: "A001"}).valid(); err != nil {
+		t.Error(err)
+	}
+
+	api := GetApi(BESTPAY_URL_AGREEMENT_DEDUCT)
+	if err := api.SetBizContent(Biz_bestpay_agreement_deduct{
+		MerchantId:  "043101180050000",
+		MerchantPwd: "123456",
+		AgreementNo: "A001",
+		OrderNo:     "14337346095601",
+		OrderReqNo:  "14337346095601",
+		OrderDate:   "20150608113649",
+		OrderAmt:    1000,
+		ProductAmt:  1000,
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if tobe := api.params.tobe_mac(); !strings.Contains(tobe, "&AGREEMENTNO=A001&") {
+		t.Errorf("扣款签名串缺少协议号 %s", tobe)
+	}
+
+	api.Run()
+}
+
+//测试 商户余额和结算查询
+func Test_bestpay_account(t *testing.T) {
+	if err := (Biz_bestpay_account_settlement{
+		MerchantId:  "043101180050000",
+		MerchantPwd: "1",
+		ReqNo:       "14337346095601",
+		ReqDate:     "20150608113649",
+		SettleDate:  "2015-06-08",
+	}).valid(); err == nil {
+		t.Error("settleDate 格式不对 应该返回错误")
+	}
+
+	r := Resp_bestpay_account_balance{}
+	if err := json.Unmarshal([]byte(`{"merchantId":"043101180050000","availableAmt":"100","frozenAmt":"20","unsettledAmt":"30","totalAmt":"150"}`), &r); err != nil {
+		t.Fatal(err)
+	}
+	if r.AvailableAmt+r.FrozenAmt+r.UnsettledAmt != r.TotalAmt {
+		t.Errorf("余额解析错误 %+v", r)
+	}
+
+	ret := QueryBalances("1", []Biz_bestpay_account_balance{{
+		MerchantId:  "043101180050000",
+		MerchantPwd: "1",
+		ReqNo:       "14337346095601",
+		ReqDate:     "20150608113649",
+	}})
+	if _, ok := ret["043101180050000"]; !ok {
+		t.Error("缺少商户的查询结果")
+	}
+}
+
+//测试 分账结果对比
+func Test_compare_ledger(t *testing.T) {
+	sent := Ledger{}
+	sent.Set("sub01", 60)
+	sent.Set("sub02", 30)
+	sent.Set("sub03", 10)
+
+	detail, err := SetLedgers(100, sent)
+	if err != nil {
+		t.Fatal(err)
+	}
+	parsed, err := ParseLedger(detail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(parsed) != 3 || parsed.Get("sub01") != 60 {
+		t.Errorf("分账明细解析错误 %v", parsed)
+	}
+	for _, s := range []string{"sub01-60", "sub01:-100|sub02:200", "sub01:0"} {
+		if _, err := ParseLedger(s); err == nil || err.Error() != msg(MSG_LEDGER_FORMAT, strings.Split(s, "|")[0]) {
+			t.Errorf("%s 格式错误 应该返回错误 %v", s, err)
+		}
+	}
+	if err := (Ledger{}).Set("sub01", -100); err == nil {
+		t.Error("分账金额为负数 应该返回错误")
+	}
+
+	r := Resp_bestpay_ledger_query{}
+	if err := json.Unmarshal([]byte(`{"ledgerDetail":[
+		{"subMerchantId":"sub01","ledgerAmt":"60","settleStatus":"B"},
+		{"subMerchantId":"sub02","ledgerAmt":"20","settleStatus":"B"},
+		{"subMerchantId":"sub04","ledgerAmt":"10","settleStatus":"A"}]}`), &r); err != nil {
+		t.Fatal(err)
+	}
+
+	diffs := r.Compare(sent)
+	want := []string{LEDGER_DIFF_AMOUNT, LEDGER_DIFF_MISSING, LEDGER_DIFF_UNEXPECTED}
+	if len(diffs) != len(want) {
+		t.Fatalf("差异数量错误 %+v", diffs)
+	}
+	for i, d := range diffs {
+		if d.Type != want[i] {
+			t.Errorf("%s 差异类型应该是 %s 实际 %s", d.SubMerchantId, want[i], d.Type)
+		}
+	}
+}
+
+//测试 自动重试
+func Test_run_retry(t *testing.T) {
+	if !IsIdempotent(BESTPAY_URL_QUERYORDER, Biz_bestpay_queryorder{}) {
+		t.Error("交易查询应该是幂等的")
+	}
+	if IsIdempotent(BESTPAY_URL_BARCODE_PLACEORDER, Biz_bestpay_barcode_placeorder{OrderReqNo: "14337346095601"}) {
+		t.Error("下单默认不应该重试")
+	}
+	SetIdempotentRule(BESTPAY_URL_BARCODE_PLACEORDER, IdempotentBy("OrderReqNo"))
+	if !IsIdempotent(BESTPAY_URL_BARCODE_PLACEORDER, Biz_bestpay_barcode_placeorder{OrderReqNo: "14337346095601"}) {
+		t.Error("打开之后带 orderReqNo 的下单应该是幂等的")
+	}
+	SetIdempotentRule(BESTPAY_URL_BARCODE_PLACEORDER, nil)
+	if !IsIdempotent(BESTPAY_URL_COMMONREFUND, Biz_bestpay_commonrefund{RefundReqNo: "14337346095602"}) {
+		t.Error("带 refundReqNo 的退款应该是幂等的")
+	}
+	if IsIdempotent(BESTPAY_URL_GATEWAY_PAY, Biz_bestpay_gateway_pay{}) {
+		t.Error("没有注册规则的接口不应该是幂等的")
+	}
+
+	p := RetryPolicy{MaxAttempts: 4, BaseDelay: 100 * time.Millisecond, MaxDelay: 300 * time.Millisecond}
+	for attempt, want := range map[int]time.Duration{1: 100 * time.Millisecond, 2: 200 * time.Millisecond, 3: 300 * time.Millisecond, 10: 300 * time.Millisecond} {
+		if d := p.Backoff(attempt); d != want {
+			t.Errorf("第 %d 次重试应该等待 %v 实际 %v", attempt, want, d)
+		}
+	}
+	p.Jitter = 0.5
+	if d := p.Backoff(1); d < 50*time.Millisecond || d > 100*time.Millisecond {
+		t.Errorf("抖动之后的等待时间超出范围 %v", d)
+	}
+
+	sleeps := []time.Duration{}
+	retrySleep = func(ctx context.Context, d time.Duration) error {
+		sleeps = append(sleeps, d)
+		return ctx.Err()
+	}
+	defer func() { retrySleep = sleepContext }()
+
+	//总是失败.执行满 MaxAttempts 次
+	p.RetryOn = func(err error, raw string) bool { return true }
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	if err := api.SetBizContent(Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	api.RunRetry(p)
+	if api.Attempts() != 4 || len(sleeps) != 3 {
+		t.Errorf("交易查询应该执行 4 次 实际 %d 次 等待 %d 次", api.Attempts(), len(sleeps))
+	}
+
+	//不幂等的接口只执行一次
+	SetIdempotentRule(BESTPAY_URL_QUERYORDER, nil)
+	defer SetIdempotentRule(BESTPAY_URL_QUERYORDER, AlwaysIdempotent)
+	api.RunRetry(p)
+	if api.Attempts() != 1 {
+		t.Errorf("不幂等的接口应该只执行 1 次 实际 %d 次", api.Attempts())
+	}
+	SetIdempotentRule(BESTPAY_URL_QUERYORDER, AlwaysIdempotent)
+
+	//ctx 结束之后不再等待重试
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	sleeps = sleeps[:0]
+	if err := api.RunRetryContext(ctx, p); err != context.Canceled || api.Attempts() != 1 {
+		t.Errorf("ctx 结束之后应该停止重试 %v %d", err, api.Attempts())
+	}
+	if err := sleepContext(ctx, time.Hour); err != context.Canceled {
+		t.Errorf("ctx 结束之后不应该继续等待 %v", err)
+	}
+}
+
+//测试 熔断和限流
+func Test_circuit_breaker(t *testing.T) {
+	now := time.Date(2017, 9, 1, 0, 0, 0, 0, time.Local)
+	breakerNow = func() time.Time { return now }
+	defer func() { breakerNow = time.Now }()
+
+	changes := []string{}
+	cb := NewCircuitBreaker(BreakerConfig{
+		FailureThreshold: 2,
+		OpenTimeout:      10 * time.Second,
+		OnStateChange:    func(key, from, to string) { changes = append(changes, key+":"+to) },
+	})
+	keys := BreakerKeys(BESTPAY_URL_QUERYORDER, "043101180050000")
+
+	for i := 0; i < 2; i++ {
+		if err := cb.Allow(keys...); err != nil {
+			t.Fatal(err)
+		}
+		cb.Done(true, keys...)
+	}
+	if s := cb.State(keys[1]); s.State != BREAKER_OPEN || s.Failures != 2 {
+		t.Errorf("连续失败 2 次应该熔断 %+v", s)
+	}
+	if err, ok := cb.Allow(keys...).(*GuardError); !ok || err.Reason != GUARD_CIRCUIT_OPEN {
+		t.Error("熔断中应该拒绝请求")
+	}
+
+	//超时之后半开.只放行一个
+	now = now.Add(10 * time.Second)
+	if err := cb.Allow(keys...); err != nil {
+		t.Fatal(err)
+	}
+	if err := cb.Allow(keys...); err == nil {
+		t.Error("半开时只能放行一个请求")
+	}
+	cb.Done(false, keys...)
+	if s := cb.State(keys[0]); s.State != BREAKER_CLOSED {
+		t.Errorf("试探成功之后应该恢复 %+v", s)
+	}
+	if len(cb.States()) != 2 || len(changes) != 6 {
+		t.Errorf("状态变化记录错误 %v", changes)
+	}
+
+	ctx := context.Background()
+	tb := NewTokenBucket(1, 2, 0)
+	if tb.Take(ctx) != nil || tb.Take(ctx) != nil || tb.Take(ctx) == nil {
+		t.Error("令牌桶容量应该是 2")
+	}
+	now = now.Add(time.Second)
+	if tb.Tokens() != 1 || tb.Take(ctx) != nil {
+		t.Error("1 秒之后应该补充 1 个令牌")
+	}
+
+	//等待令牌时 ctx 结束.不能一直等.令牌还回去
+	waited := time.Duration(0)
+	limiterSleep = func(ctx context.Context, d time.Duration) error {
+		waited += d
+		return ctx.Err()
+	}
+	defer func() { limiterSleep = sleepContext }()
+	wait := NewTokenBucket(1, 1, time.Minute)
+	wait.Take(ctx)
+	cancelled, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := wait.Take(cancelled); err != context.Canceled || waited != time.Second {
+		t.Errorf("ctx 结束之后应该返回 ctx.Err() %v %v", err, waited)
+	}
+	if wait.Tokens() != 0 {
+		t.Errorf("取消之后令牌应该还回去 %v", wait.Tokens())
+	}
+	if err := wait.Take(ctx); err != nil || waited != 2*time.Second {
+		t.Errorf("没有令牌时应该等待 %v %v", err, waited)
+	}
+
+	SetRateLimiter(tb)
+	defer SetRateLimiter(nil)
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	api.SetBizContent(Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}, "1")
+	if err := api.RunRetry(DefaultRetryPolicy()); err == nil || api.Attempts() != 1 {
+		t.Errorf("限流之后应该直接返回错误并且不重试 %v %d", err, api.Attempts())
+	}
+}
+
+//测试 拦截器
+func Test_interceptor(t *testing.T) {
+	defer ResetInterceptors()
+
+	order := []string{}
+	var fail error
+	Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			order = append(order, "outer")
+			if inv.Params["mac"] == nil || inv.ApiName != "交易查询" {
+				t.Errorf("拦截器应该能看到签名之后的参数 %+v", inv)
+			}
+			return next(inv)
+		}
+	}, func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			order = append(order, "inner")
+			if fail != nil {
+				return fail
+			}
+			//不调用 next.模拟网关返回
+			inv.Raw = `{"success":true,"result":{"transStatus":"B"}}`
+			return nil
+		}
+	})
+
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	if err := api.SetBizContent(Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.Run(); err != nil {
+		t.Fatal(err)
+	}
+
+	if strings.Join(order, ",") != "outer,inner" {
+		t.Errorf("拦截器执行顺序错误 %v", order)
+	}
+	r := Resp_bestpay_queryorder{}
+	if _, err := api.Response(&r); err != nil || r.TransStatus != TRANS_STATUS_SUCCESS {
+		t.Errorf("应该使用拦截器返回的数据 %v %+v", err, r)
+	}
+
+	//再次执行失败之后不能留着上一次的响应
+	fail = errors.New("timeout")
+	if err := api.Run(); err != fail {
+		t.Fatalf("应该返回拦截器的错误 %v", err)
+	}
+	if api.raw != "" {
+		t.Errorf("失败之后不应该保留上一次的响应 %s", api.raw)
+	}
+}
+
+//测试 ctx 用于网络请求
+func Test_request_context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	if err := api.SetBizContent(Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := api.WithContext(ctx).Run(); err == nil || !strings.Contains(err.Error(), context.Canceled.Error()) {
+		t.Errorf("ctx 结束之后请求应该直接返回 %v", err)
+	}
+
+	//RunRetryContext 的 ctx 只用于这一次
+	defer ResetInterceptors()
+	Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			if err := inv.Ctx.Err(); err != nil {
+				return err
+			}
+			inv.Raw = `{"success":true,"result":{"transStatus":"B"}}`
+			return nil
+		}
+	})
+	api.WithContext(nil)
+	if err := api.RunRetryContext(ctx, RetryPolicy{}); err != context.Canceled {
+		t.Errorf("RunRetryContext 应该使用传入的 ctx %v", err)
+	}
+	if err := api.Run(); err != nil {
+		t.Errorf("RunRetryContext 的 ctx 不应该留在 api 上 %v", err)
+	}
+}
+
+type testObserver struct {
+	obs []Observation
+}
+
+func (o *testObserver) Begin(inv *Invocation) func(Observation) {
+	return func(ob Observation) {
+		o.obs = append(o.obs, ob)
+	}
+}
+
+//测试 监控埋点
+func Test_observe(t *testing.T) {
+	defer ResetInterceptors()
+
+	o := &testObserver{}
+	Use(Observe(o), func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			inv.Raw = `{"success":"false","errorCode":"ORDER_NOT_EXIST","result":{"transStatus":"C"}}`
+			return nil
+		}
+	})
+
+	api := GetApi(BESTPAY_URL_QUERYORDER)
+	api.SetBizContent(Biz_bestpay_queryorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+	}, "1")
+	api.Run()
+
+	if len(o.obs) != 1 {
+		t.Fatalf("应该记录 1 次调用 实际 %d", len(o.obs))
+	}
+	ob := o.obs[0]
+	if ob.MerchantId != "043101180050000" || ob.OrderNo != "14337346095601" || ob.Success || ob.ErrorCode != "ORDER_NOT_EXIST" || ob.TransStatus != TRANS_STATUS_FAIL {
+		t.Errorf("观测数据错误 %+v", ob)
+	}
+}
+
+//测试 订单状态机
+func Test_order_machine(t *testing.T) {
+	m := NewOrderMachine(NewMemoryOrderStore())
+	if _, err := m.Create(Order{MerchantId: "043101180050000", OrderNo: "14337346095601", OrderAmt: 100}); err != nil {
+		t.Fatal(err)
+	}
+
+	paid, err := EventFromNotify(Notify_bestpay_pay{RetnCode: NOTIFY_RETN_SUCCESS, OrderAmount: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	steps := []struct {
+		event OrderEvent
+		state string
+		err   bool
+	}{
+		{EventFromPlaceOrder(Resp_bestpay_barcode_placeorder{TransStatus: TRANS_STATUS_PAYING}), ORDER_PAYING, false},
+		{paid, ORDER_PAID, false},
+		{EventFromQueryOrder(Resp_bestpay_queryorder{TransStatus: TRANS_STATUS_SUCCESS, TransAmt: 100, Coupon: 10}), ORDER_PAID, false},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R1", TransAmt: 40}), ORDER_PARTIALLY_REFUNDED, false},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R1", TransAmt: 40}), ORDER_PARTIALLY_REFUNDED, false},
+		{EventFromQueryOrder(Resp_bestpay_queryorder{TransStatus: TRANS_STATUS_SUCCESS}), ORDER_PARTIALLY_REFUNDED, false},
+		{EventFromReverse(Resp_bestpay_reverse{}), ORDER_PARTIALLY_REFUNDED, true},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R2", TransAmt: 60}), ORDER_PARTIALLY_REFUNDED, true},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R2", TransAmt: 50}), ORDER_REFUNDED, false},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R3", TransAmt: 0}), ORDER_REFUNDED, false},
+		{EventFromRefund(Resp_bestpay_commonrefund{RefundReqNo: "R4", TransAmt: 10}), ORDER_REFUNDED, true},
+		{EventFromCloseOrder(Resp_bestpay_closeorder{}), ORDER_REFUNDED, true},
+	}
+
+	for i, step := range steps {
+		o, err := m.Apply("043101180050000", "14337346095601", step.event)
+		if (err != nil) != step.err {
+			t.Errorf("第 %d 步 错误不符合预期 %v", i, err)
+		}
+		if err == nil && o.State != step.state {
+			t.Errorf("第 %d 步 状态应该是 %s 实际 %s", i, step.state, o.State)
+		}
+	}
+
+	o, _ := m.Store.Get("043101180050000", "14337346095601")
+	if o.RefundedAmt() != 90 || o.RefundableAmt() != 0 || len(o.Refunds) != 3 || o.Version != 7 {
+		t.Errorf("订单数据错误 %+v", o)
+	}
+	if _, err := m.Apply("043101180050000", "none", OrderEvent{Type: ORDER_EVENT_CLOSE}); err != ErrOrderNotFound {
+		t.Errorf("订单不存在 应该返回 ErrOrderNotFound %v", err)
+	}
+}
+
+//测试 异步通知验签
+func Test_notify(t *testing.T) {
+	v := url.Values{}
+	v.Set("UPTRANSEQ", "20150608000001")
+	v.Set("TRANDATE", "20150608")
+	v.Set("RETNCODE", NOTIFY_RETN_SUCCESS)
+	v.Set("ORDERREQTRANSEQ", "14337346095601")
+	v.Set("ORDERSEQ", "14337346095601")
+	v.Set("ORDERAMOUNT", "1.00")
+	v.Set("SIGN", notifySign(v, "KEY"))
+
+	n, err := ParseNotify(v, "KEY")
+	if err != nil || n.OrderAmount != 100 {
+		t.Fatalf("验签失败 %v %+v", err, n)
+	}
+	if e, err := EventFromNotify(n); err != nil || e.TransStatus != TRANS_STATUS_SUCCESS {
+		t.Errorf("0000 应该是支付成功 %v %+v", err, e)
+	}
+
+	if _, err := ParseNotify(v, "OTHER"); err == nil {
+		t.Error("秘钥不对 应该返回错误")
+	}
+	v.Set("ORDERAMOUNT", "0.01")
+	if _, err := ParseNotify(v, "KEY"); err == nil {
+		t.Error("金额被修改 应该返回错误")
+	}
+	v.Set("SIGN", notifySign(v, "KEY"))
+	if n, err := ParseNotify(v, "KEY"); err != nil || n.OrderAmount != 1 {
+		t.Errorf("0.01 元应该是 1 分 %v %+v", err, n)
+	}
+	v.Set("ORDERAMOUNT", "0.001")
+	v.Set("SIGN", notifySign(v, "KEY"))
+	if _, err := ParseNotify(v, "KEY"); err == nil {
+		t.Error("超过两位小数 应该返回错误")
+	}
+	v.Del("SIGN")
+	if _, err := ParseNotify(v, "KEY"); err == nil {
+		t.Error("没有签名 应该返回错误")
+	}
+
+	//没有设置过的返回码不能变为失败
+	n.RetnCode = "9999"
+	if _, err := EventFromNotify(n); err == nil {
+		t.Error("未知的返回码 应该返回错误")
+	}
+	SetNotifyFailCodes("9999")
+	defer SetNotifyFailCodes()
+	if e, err := EventFromNotify(n); err != nil || e.TransStatus != TRANS_STATUS_FAIL {
+		t.Errorf("设置过的返回码应该是支付失败 %v %+v", err, e)
+	}
+}
+
+//MemoryOrderStore 和 SQLOrderStore 的 ListStale 用同样的数据测试.结果应该一致
+func checkListStale(t *testing.T, s interface {
+	OrderStore
+	StaleOrderLister
+}) {
+	now := time.Date(2017, 9, 1, 0, 0, 0, 0, time.Local)
+	orders := []Order{
+		{OrderNo: "14337346095601", State: ORDER_PAYING, UpdatedAt: now.Add(2 * time.Minute)},
+		{OrderNo: "14337346095603", State: ORDER_CREATED, UpdatedAt: now},
+		{OrderNo: "14337346095605", State: ORDER_PAID, UpdatedAt: now},
+		{OrderNo: "14337346095607", State: ORDER_PAYING, UpdatedAt: now.Add(time.Hour)},
+	}
+	for _, o := range orders {
+		o.MerchantId = "043101180050000"
+		o.Version = 1
+		if err := s.Insert(o); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	states := []string{ORDER_CREATED, ORDER_PAYING}
+	for _, c := range []struct {
+		limit int
+		want  []string
+	}{
+		{0, []string{"14337346095603", "14337346095601"}},
+		{-1, []string{"14337346095603", "14337346095601"}},
+		{1, []string{"14337346095603"}},
+		{5, []string{"14337346095603", "14337346095601"}},
+	} {
+		stale, err := s.ListStale(states, now.Add(30*time.Minute), c.limit)
+		if err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, o := range stale {
+			got = append(got, o.OrderNo)
+		}
+		if strings.Join(got, ",") != strings.Join(c.want, ",") {
+			t.Errorf("limit=%d 应该是 %v 实际为 %v", c.limit, c.want, got)
+		}
+	}
+
+	if stale, err := s.ListStale(nil, now.Add(30*time.Minute), 0); err != nil || len(stale) != 0 {
+		t.Errorf("没有状态 应该返回空 %v %+v", err, stale)
+	}
+}
+
+//测试 内存订单存储 ListStale
+func Test_memory_store_list_stale(t *testing.T) {
+	checkListStale(t, NewMemoryOrderStore())
+}
+
+//测试 订单存储
+func Test_order_store(t *testing.T) {
+	s := NewMemoryOrderStore()
+	o := Order{MerchantId: "043101180050000", OrderNo: "14337346095601", OrderReqNo: "14337346095602", Version: 1}
+	if err := s.Insert(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Insert(Order{MerchantId: "043101180050000", OrderNo: "14337346095603", OrderReqNo: "14337346095602"}); err != ErrOrderExists {
+		t.Errorf("orderReqNo 重复 应该返回 ErrOrderExists %v", err)
+	}
+	for _, no := range []string{"14337346095605", "14337346095607"} {
+		if err := s.Insert(Order{MerchantId: "043101180050000", OrderNo: no}); err != nil {
+			t.Errorf("orderReqNo 为空 应该可以保存 %v", err)
+		}
+	}
+
+	o.Version = 2
+	o.Refunds = []OrderRefund{{RefundReqNo: "R1", Amount: 10}}
+	if err := s.Update(o); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Update(o); err != ErrOrderConflict {
+		t.Errorf("版本相同 应该返回 ErrOrderConflict %v", err)
+	}
+
+	if v, err := s.GetByReqNo("043101180050000", "14337346095602"); err != nil || v.OrderNo != o.OrderNo {
+		t.Errorf("按 orderReqNo 查找错误 %v %+v", err, v)
+	}
+	if v, err := s.GetByRefundReqNo("043101180050000", "R1"); err != nil || v.Version != 2 {
+		t.Errorf("按 refundReqNo 查找错误 %v %+v", err, v)
+	}
+	if _, err := s.GetByRefundReqNo("043101180050009", "R1"); err != ErrOrderNotFound {
+		t.Errorf("其它商户的退款 应该返回 ErrOrderNotFound %v", err)
+	}
+
+	pg := NewSQLOrderStore(nil, SQL_DIALECT_POSTGRES)
+	if q := pg.rebind("a = ? AND b = ?"); q != "a = $1 AND b = $2" {
+		t.Errorf("postgres 占位符错误 %s", q)
+	}
+	if q := NewSQLOrderStore(nil, SQL_DIALECT_MYSQL).rebind("a = ?"); q != "a = ?" {
+		t.Errorf("mysql 占位符错误 %s", q)
+	}
+}
+
+//测试 退款金额检查
+func Test_refund_guard(t *testing.T) {
+	store := NewMemoryOrderStore()
+	store.Insert(Order{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		TransAmt:   100,
+		Coupon:     10,
+		State:      ORDER_PARTIALLY_REFUNDED,
+		Refunds:    []OrderRefund{{RefundReqNo: "R1", Amount: 50}},
+		Version:    1,
+	})
+
+	biz := Biz_bestpay_commonrefund{
+		MerchantId:    "043101180050000",
+		MerchantPwd:   "1",
+		OldOrderNo:    "14337346095601",
+		OldOrderReqNo: "14337346095601",
+		RefundReqNo:   "R2",
+		RefundReqDate: "20150608",
+		TransAmt:      41,
+		Channel:       "05",
+	}
+
+	g := NewRefundGuard(store, "1")
+	if err := g.Check(biz, ""); err == nil {
+		t.Error("退款金额超过 100-10-50 应该返回错误")
+	}
+	biz.TransAmt = 40
+	if err := g.Check(biz, ""); err != nil {
+		t.Error(err)
+	}
+	biz.RefundReqNo, biz.TransAmt = "R1", 50
+	if err := g.Check(biz, ""); err != nil {
+		t.Errorf("已经成功的退款重复提交 应该通过 %v", err)
+	}
+
+	//存储中没有.用交易查询
+	biz.OldOrderNo, biz.RefundReqNo, biz.TransAmt = "14337346095603", "R3", 95
+	if err := g.Check(biz, ""); err == nil {
+		t.Error("没有 orderDate 时找不到原订单 应该返回错误")
+	}
+	g.query = func(ctx context.Context, q Biz_bestpay_queryorder, key string) (Resp_bestpay_queryorder, error) {
+		return Resp_bestpay_queryorder{TransAmt: 100, Coupon: 10, TransStatus: TRANS_STATUS_SUCCESS}, nil
+	}
+	if err := g.Check(biz, "20150608113649"); err == nil {
+		t.Error("退款金额超过 100-10 应该返回错误")
+	}
+
+	//存储中还是支付中的.用存储中的 orderDate 查询
+	store.Insert(Order{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095605",
+		OrderReqNo: "14337346095605",
+		OrderDate:  "20150608113649",
+		OrderAmt:   100,
+		State:      ORDER_PAYING,
+		Version:    1,
+	})
+	queried := ""
+	g.query = func(ctx context.Context, q Biz_bestpay_queryorder, key string) (Resp_bestpay_queryorder, error) {
+		queried = q.OrderDate
+		return Resp_bestpay_queryorder{TransAmt: 100, Coupon: 10, TransStatus: TRANS_STATUS_SUCCESS}, nil
+	}
+	biz.OldOrderNo, biz.RefundReqNo, biz.TransAmt = "14337346095605", "R4", 90
+	if err := g.Check(biz, ""); err != nil || queried != "20150608113649" {
+		t.Errorf("支付中的订单应该用交易查询确认 %v %s", err, queried)
+	}
+
+	//SetBizContent 时自动检查
+	SetRefundGuard(g)
+	defer SetRefundGuard(nil)
+	biz.OldOrderNo, biz.TransAmt = "14337346095601", 41
+	api := GetApi(BESTPAY_URL_COMMONREFUND)
+	if err := api.SetBizContent(biz, "1"); err == nil {
+		t.Error("SetBizContent 应该检查退款金额")
+	}
+	biz.OldOrderNo, biz.TransAmt = "14337346095605", 91
+	if err := api.SetBizContent(biz, "1"); err == nil {
+		t.Error("SetBizContent 应该用交易查询检查支付中的订单")
+	}
+
+	//交易查询使用 SetBizContentContext 的 ctx
+	g.query = func(ctx context.Context, q Biz_bestpay_queryorder, key string) (Resp_bestpay_queryorder, error) {
+		<-ctx.Done()
+		return Resp_bestpay_queryorder{}, ctx.Err()
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	biz.TransAmt = 90
+	if err := api.SetBizContentContext(ctx, biz, "1"); err != context.Canceled {
+		t.Errorf("ctx 取消 交易查询应该返回 context.Canceled %v", err)
+	}
+	if err := api.WithContext(ctx).SetBizContent(biz, "1"); err != context.Canceled {
+		t.Errorf("SetBizContent 应该使用 WithContext 的 ctx %v", err)
+	}
+}
+
+//测试 未支付订单清理
+func Test_expiry_sweeper(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.Local)
+	orderNow = func() time.Time { return now }
+	defer func() { orderNow = time.Now }()
+
+	store := NewMemoryOrderStore()
+	m := NewOrderMachine(store)
+	for _, no := range []string{"OD01", "OD02", "OD03", "OD04"} {
+		m.Create(Order{MerchantId: "043101180050000", OrderNo: no, OrderReqNo: no, OrderDate: "20170901100000", OrderAmt: 100})
+	}
+	m.Apply("043101180050000", "OD01", OrderEvent{Type: ORDER_EVENT_PAY, TransStatus: TRANS_STATUS_PAYING})
+	m.Apply("043101180050000", "OD02", OrderEvent{Type: ORDER_EVENT_PAY, TransStatus: TRANS_STATUS_PAYING})
+	m.Apply("043101180050000", "OD03", OrderEvent{Type: ORDER_EVENT_PAY, TransStatus: TRANS_STATUS_PAYING})
+	now = now.Add(10 * time.Minute)
+
+	calls := []string{}
+	s := NewExpirySweeper(store, "1", "1")
+	s.call = func(ctx context.Context, method string, biz bizInterface, key string, result interface{}) error {
+		no := bizField(biz, "OrderNo") + bizField(biz, "OldOrderNo")
+		calls = append(calls, method+":"+no)
+		if method != BESTPAY_URL_QUERYORDER {
+			return nil
+		}
+		switch no {
+		case "OD01":
+			result.(*Resp_bestpay_queryorder).TransStatus = TRANS_STATUS_SUCCESS
+		case "OD02":
+			result.(*Resp_bestpay_queryorder).TransStatus = TRANS_STATUS_PAYING
+		case "OD03":
+			return errors.New("timeout")
+		case "OD04":
+			return errors.New("order not exist")
+		}
+		return nil
+	}
+
+	//不是 leader 不执行
+	s.IsLeader = func(ctx context.Context) bool { return false }
+	if results, _ := s.SweepOnce(context.Background()); len(results) != 0 || len(calls) != 0 {
+		t.Error("不是 leader 不应该执行")
+	}
+
+	s.IsLeader = nil
+	results, err := s.SweepOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"OD01": SWEEP_RESOLVED, "OD02": SWEEP_REVERSED, "OD03": SWEEP_FAILED, "OD04": SWEEP_REVERSED}
+	if len(results) != len(want) {
+		t.Fatalf("应该处理 %d 笔 实际 %d", len(want), len(results))
+	}
+	for _, r := range results {
+		if want[r.Order.OrderNo] != r.Result {
+			t.Errorf("%s 应该是 %s 实际 %s %v", r.Order.OrderNo, want[r.Order.OrderNo], r.Result, r.Err)
+		}
+	}
+	if o, _ := store.Get("043101180050000", "OD02"); o.State != ORDER_REVERSED {
+		t.Errorf("OD02 应该已撤单 %s", o.State)
+	}
+
+	//已经处理的不再出现.ctx 结束之后 Run 返回
+	results, _ = s.SweepOnce(context.Background())
+	if len(results) != 1 || results[0].Order.OrderNo != "OD03" {
+		t.Errorf("下一轮只应该处理 OD03 %+v", results)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := s.Run(ctx); err != nil {
+		t.Error(err)
+	}
+}
+
+//测试 未支付订单清理 Run 的 ctx 结束时正在执行的撤单继续完成
+func Test_expiry_sweeper_shutdown(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.Local)
+	orderNow = func() time.Time { return now }
+	defer func() { orderNow = time.Now }()
+
+	store := NewMemoryOrderStore()
+	m := NewOrderMachine(store)
+	for _, no := range []string{"OD01", "OD02"} {
+		m.Create(Order{MerchantId: "043101180050000", OrderNo: no, OrderReqNo: no, OrderDate: "20170901100000", OrderAmt: 100})
+		m.Apply("043101180050000", no, OrderEvent{Type: ORDER_EVENT_PAY, TransStatus: TRANS_STATUS_PAYING})
+	}
+	now = now.Add(10 * time.Minute)
+
+	inflight := make(chan struct{})
+	release := make(chan struct{})
+	var reverseErr error
+	reversed := []string{}
+	s := NewExpirySweeper(store, "1", "1")
+	s.call = func(ctx context.Context, method string, biz bizInterface, key string, result interface{}) error {
+		if method == BESTPAY_URL_QUERYORDER {
+			result.(*Resp_bestpay_queryorder).TransStatus = TRANS_STATUS_PAYING
+			return nil
+		}
+		reversed = append(reversed, bizField(biz, "OldOrderNo"))
+		if len(reversed) == 1 {
+			close(inflight)
+			<-release
+		}
+		//撤单请求的 ctx 不应该被 Run 的 ctx 取消
+		reverseErr = ctx.Err()
+		return reverseErr
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- s.Run(ctx) }()
+
+	<-inflight
+	cancel()
+	close(release)
+	if err := <-done; err != nil {
+		t.Error(err)
+	}
+
+	if reverseErr != nil {
+		t.Errorf("正在执行的撤单不应该被取消 %v", reverseErr)
+	}
+	if len(reversed) != 1 {
+		t.Errorf("ctx 结束之后不应该处理下一笔订单 %v", reversed)
+	}
+	if o, _ := store.Get("043101180050000", reversed[0]); o.State != ORDER_REVERSED {
+		t.Errorf("%s 应该已撤单 %s", reversed[0], o.State)
+	}
+}
+
+//测试 未支付订单清理 经过 SetBizContent 校验
+func Test_expiry_sweeper_valid(t *testing.T) {
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.Local)
+	orderNow = func() time.Time { return now }
+	defer func() { orderNow = time.Now }()
+
+	store := NewMemoryOrderStore()
+	m := NewOrderMachine(store)
+	long := strings.Repeat("12", 15)
+	m.Create(Order{MerchantId: "043101180050000", OrderNo: long, OrderReqNo: long, OrderDate: "20170901100000", OrderAmt: 100})
+	m.Create(Order{MerchantId: "043101180050000", OrderNo: "OD02", OrderDate: "20170901100000", OrderAmt: 100})
+	now = now.Add(10 * time.Minute)
+
+	defer ResetInterceptors()
+	sent := map[string]map[string]interface{}{}
+	Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			sent[inv.Method] = inv.Params
+			inv.Raw = `{"success":true,"result":{"transStatus":"A"}}`
+			return nil
+		}
+	})
+
+	results, err := NewExpirySweeper(store, "1", "123456").SweepOnce(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{long: SWEEP_REVERSED, "OD02": SWEEP_SKIPPED}
+	for _, r := range results {
+		if want[r.Order.OrderNo] != r.Result {
+			t.Errorf("%s 应该是 %s 实际 %s %v", r.Order.OrderNo, want[r.Order.OrderNo], r.Result, r.Err)
+		}
+	}
+	no, _ := sent[BESTPAY_URL_REVERSE]["refundReqNo"].(string)
+	if len(no) != 30 || no != sweepRefundReqNo(Order{MerchantId: "043101180050000", OrderNo: long}) {
+		t.Errorf("撤单流水不正确 %s", no)
+	}
+}
+
+//测试 签名后的请求参数.固定下来防止 struct_to_map 改动后悄悄改变报文
+func Test_signed_params(t *testing.T) {
+	barcode := Biz_bestpay_barcode_placeorder{
+		MerchantId: "043101180050000",
+		Barcode:    "515665002854886972",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   100,
+		ProductAmt: 100,
+		StoreId:    "201231",
+		Attach:     "a&b",
+	}
+	barcode.AddGoodsDetail(NewGoodsDetailItem("1001", "可乐", 1, 100))
+
+	refund := Biz_bestpay_commonrefund{
+		MerchantId:    "043101180050000",
+		MerchantPwd:   "123456",
+		OldOrderNo:    "14337346095601",
+		OldOrderReqNo: "14337346095601",
+		RefundReqNo:   "14337346095602",
+		RefundReqDate: "20150608",
+		TransAmt:      100,
+	}
+
+	qrcode := Biz_bestpay_qrcode_placeorder{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   1,
+		ProductAmt: 1,
+		StoreId:    "201231",
+	}
+
+	h5 := Biz_bestpay_h5_order{
+		MerchantId: "043101180050000",
+		OrderNo:    "14337346095601",
+		OrderReqNo: "14337346095601",
+		OrderDate:  "20150608113649",
+		OrderAmt:   1,
+		ProductAmt: 1,
+	}
+	app := Biz_bestpay_app_order(h5)
+
+	for _, c := range []struct {
+		method string
+		biz    bizInterface
+		want   map[string]string
+	}{
+		{BESTPAY_URL_BARCODE_PLACEORDER, barcode, map[string]string{
+			"merchantId":  "043101180050000",
+			"barcode":     "515665002854886972",
+			"orderNo":     "14337346095601",
+			"orderReqNo":  "14337346095601",
+			"channel":     "05",
+			"busiType":    "0000001",
+			"orderDate":   "20150608113649",
+			"orderAmt":    "100",
+			"productAmt":  "100",
+			"attachAmt":   "0",
+			"storeId":     "201231",
+			"attach":      "a&b",
+			"goodsDetail": `[{"goodsId":"1001","goodsName":"可乐","quantity":"1","price":"100"}]`,
+			"mac":         "E7768EE8FB2E61FB61F64D00DEEF9C34",
+		}},
+		{BESTPAY_URL_COMMONREFUND, refund, map[string]string{
+			"merchantId":    "043101180050000",
+			"merchantPwd":   "123456",
+			"oldOrderNo":    "14337346095601",
+			"oldOrderReqNo": "14337346095601",
+			"refundReqNo":   "14337346095602",
+			"refundReqDate": "20150608",
+			"transAmt":      "100",
+			"channel":       "05",
+			"mac":           "C25C7BE92D4F3D2355A6D2B2B5DFCB6C",
+		}},
+		{BESTPAY_URL_QRCODE_PLACEORDER, qrcode, map[string]string{
+			"merchantId": "043101180050000",
+			"orderNo":    "14337346095601",
+			"orderReqNo": "14337346095601",
+			"channel":    "05",
+			"busiType":   "0000001",
+			"orderDate":  "20150608113649",
+			"orderAmt":   "1",
+			"productAmt": "1",
+			"attachAmt":  "0",
+			"storeId":    "201231",
+			"mac":        "8D5BBE164169A4ED0A0C9E74BC370CBD",
+		}},
+		{BESTPAY_URL_APP_ORDER, app, map[string]string{
+			"merchantId": "043101180050000",
+			"orderNo":    "14337346095601",
+			"orderReqNo": "14337346095601",
+			"busiType":   "0000001",
+			"orderDate":  "20150608113649",
+			"orderAmt":   "1",
+			"productAmt": "1",
+			"attachAmt":  "0",
+			"mac":        "8D5BBE164169A4ED0A0C9E74BC370CBD",
+		}},
+		{BESTPAY_URL_H5_ORDER, h5, map[string]string{
+			"merchantId": "043101180050000",
+			"orderNo":    "14337346095601",
+			"orderReqNo": "14337346095601",
+			"busiType":   "0000001",
+			"orderDate":  "20150608113649",
+			"orderAmt":   "1",
+			"productAmt": "1",
+			"attachAmt":  "0",
+			"mac":        "8D5BBE164169A4ED0A0C9E74BC370CBD",
+		}},
+	} {
+		api := GetApi(c.method)
+		if err := api.SetBizContent(c.biz, "KEY"); err != nil {
+			t.Fatal(err)
+		}
+		params, err := api.signed_params()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(params) != len(c.want) {
+			t.Errorf("%s 参数个数不正确 %v", c.method, params)
+		}
+		for k, v := range c.want {
+			if params[k] != v {
+				t.Errorf("%s 参数 %s 应该为 %s 实际为 %s", c.method, k, v, params[k])
+			}
+		}
+	}
+}
+
+func batchRefunds(n int) []Biz_bestpay_commonrefund {
+	refunds := []Biz_bestpay_commonrefund{}
+	for i := 0; i < n; i++ {
+		no := string(rune('A'+i)) + "0"
+		refunds = append(refunds, Biz_bestpay_commonrefund{
+			MerchantId:  "043101180050000",
+			OldOrderNo:  "OD" + no,
+			RefundReqNo: "RF" + no,
+			TransAmt:    100,
+		})
+	}
+	return refunds
+}
+
+//测试 批量退款 中断之后继续执行
+func Test_batchrefund_resume(t *testing.T) {
+	dir, err := ioutil.TempDir("", "batchrefund")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	var mutex sync.Mutex
+	calls := map[string]int{}
+	fail := map[string]bool{"RFB0": true}
+
+	br := NewBatchRefund("1")
+	br.Concurrency = 3
+	br.Rate = 1000
+	br.Progress = NewFileRefundProgress(filepath.Join(dir, "refund.progress"))
+	br.refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+		mutex.Lock()
+		calls[biz.RefundReqNo]++
+		failed := fail[biz.RefundReqNo]
+		mutex.Unlock()
+		return RefundResult{
+			OldOrderNo:  biz.OldOrderNo,
+			RefundReqNo: biz.RefundReqNo,
+			TransAmt:    biz.TransAmt,
+			Success:     !failed,
+		}
+	}
+
+	refunds := batchRefunds(5)
+	results, err := br.Run(context.Background(), refunds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := SummarizeRefunds(results); s.Success != 4 || s.Fail != 1 || s.SuccessAmt != 400 {
+		t.Errorf("汇总不正确 %+v", s)
+	}
+
+	//第二次执行只重试失败的
+	delete(fail, "RFB0")
+	results, err = br.Run(context.Background(), refunds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, r := range results {
+		if !r.Success || r.RefundReqNo != refunds[i].RefundReqNo {
+			t.Errorf("第 %d 笔结果不正确 %+v", i, r)
+		}
+	}
+	for no, n := range calls {
+		if want := map[bool]int{true: 2, false: 1}[no == "RFB0"]; n != want {
+			t.Errorf("%s 执行了 %d 次 应该是 %d 次", no, n, want)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := WriteRefundReport(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	if lines := strings.Split(strings.TrimSpace(buf.String()), "\n"); len(lines) != 6 {
+		t.Errorf("报告行数不正确\n%s", buf.String())
+	}
+}
+
+//测试 批量退款 refundReqNo 重复
+func Test_batchrefund_duplicated(t *testing.T) {
+	br := NewBatchRefund("1")
+	br.refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+		return RefundResult{RefundReqNo: biz.RefundReqNo, Success: true}
+	}
+
+	refunds := batchRefunds(2)
+	refunds = append(refunds, refunds[0])
+	results, err := br.Run(context.Background(), refunds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if results[2].Success || results[2].ErrorMsg != msg(MSG_REFUND_DUPLICATED) {
+		t.Errorf("重复的 refundReqNo 不应该执行 %+v", results[2])
+	}
+}
+
+//测试 批量退款 已经成功的 refundReqNo 重复时只计一次
+func Test_batchrefund_duplicated_done(t *testing.T) {
+	br := NewBatchRefund("1")
+	br.Progress = memRefundProgress{"RFA0": {RefundReqNo: "RFA0", TransAmt: 100, Success: true}}
+	br.refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+		return RefundResult{RefundReqNo: biz.RefundReqNo, TransAmt: biz.TransAmt, Success: true}
+	}
+
+	refunds := batchRefunds(2)
+	refunds = append(refunds, refunds[0])
+	results, err := br.Run(context.Background(), refunds)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := SummarizeRefunds(results); s.Success != 2 || s.SuccessAmt != 200 {
+		t.Errorf("已经成功的退款重复时不能重复计算 %+v", s)
+	}
+	if results[2].Success || results[2].ErrorMsg != msg(MSG_REFUND_DUPLICATED) {
+		t.Errorf("重复的 refundReqNo 应该标记出来 %+v", results[2])
+	}
+}
+
+//测试 批量退款 取消之后不再发起新的退款
+func Test_batchrefund_cancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	br := NewBatchRefund("1")
+	br.refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+		//第一笔执行中取消.这一笔要执行完
+		cancel()
+		return RefundResult{RefundReqNo: biz.RefundReqNo, TransAmt: biz.TransAmt, Success: true}
+	}
+
+	refunds := batchRefunds(5)
+	results, err := br.Run(ctx, refunds)
+	if err != context.Canceled {
+		t.Fatalf("取消之后应该返回 context.Canceled %v", err)
+	}
+	if !results[0].Success {
+		t.Errorf("已经发起的退款应该执行完 %+v", results[0])
+	}
+	cancelled := 0
+	for i, r := range results {
+		if r.RefundReqNo != refunds[i].RefundReqNo {
+			t.Errorf("第 %d 笔结果不正确 %+v", i, r)
+		}
+		if !r.Success {
+			if r.ErrorMsg != msg(MSG_REFUND_CANCELLED) {
+				t.Errorf("没有执行的第 %d 笔应该标记为取消 %+v", i, r)
+			}
+			cancelled++
+		}
+	}
+	//取消的时候可能已经有一笔交给了 worker
+	if cancelled < 3 {
+		t.Errorf("取消之后不应该继续发起退款 %+v", results)
+	}
+}
+
+type memRefundProgress map[string]RefundResult
+
+func (m memRefundProgress) Load() (map[string]RefundResult, error) {
+	return m, nil
+}
+
+func (m memRefundProgress) Save(r RefundResult) error {
+	return nil
+}
+
+type failRefundProgress struct{}
+
+func (failRefundProgress) Load() (map[string]RefundResult, error) {
+	return map[string]RefundResult{}, nil
+}
+
+func (failRefundProgress) Save(r RefundResult) error {
+	return errors.New("disk full")
+}
+
+//测试 批量退款 进度保存失败
+func Test_batchrefund_save_error(t *testing.T) {
+	br := NewBatchRefund("1")
+	br.Rate = 2000000000
+	br.Progress = failRefundProgress{}
+	br.refund = func(biz Biz_bestpay_commonrefund, key string) RefundResult {
+		return RefundResult{RefundReqNo: biz.RefundReqNo, Success: true}
+	}
+
+	refunds := batchRefunds(5)
+	results, err := br.Run(context.Background(), refunds)
+	if err == nil {
+		t.Fatal("进度保存失败 应该返回错误")
+	}
+	for i, r := range results {
+		if r.RefundReqNo != refunds[i].RefundReqNo {
+			t.Errorf("第 %d 笔结果不正确 %+v", i, r)
+		}
+		if !r.Success && r.ErrorMsg != msg(MSG_REFUND_NOT_RUN) {
+			t.Errorf("没有执行的第 %d 笔应该标记出来 %+v", i, r)
+		}
+	}
+}
+
+type memAuditSink struct {
+	records []AuditRecord
+}
+
+func (m *memAuditSink) Audit(r AuditRecord) error {
+	m.records = append(m.records, r)
+	return nil
+}
+
+//测试 审计记录 脱敏和验签
+func Test_audit_record(t *testing.T) {
+	sink := &memAuditSink{}
+	SetAuditSink(sink)
+	defer SetAuditSink(nil)
+	defer ResetInterceptors()
+
+	Use(func(next Invoker) Invoker {
+		return func(inv *Invocation) error {
+			inv.Raw = `{"success":true,"result":{"refundReqNo":"14337346095602","payerAccount":"18900000000","transPhone":"18900000000","sign":"ABCDEF"}}`
+			return nil
+		}
+	})
+
+	api := GetApi(BESTPAY_URL_COMMONREFUND)
+	if err := api.SetBizContent(Biz_bestpay_commonrefund{
+		MerchantId:    "043101180050000",
+		MerchantPwd:   "123456",
+		OldOrderNo:    "14337346095601",
+		OldOrderReqNo: "14337346095601",
+		RefundReqNo:   "14337346095602",
+		RefundReqDate: "20150608",
+		TransAmt:      1,
+		Channel:       "05",
+	}, "1"); err != nil {
+		t.Fatal(err)
+	}
+	api.Run()
+
+	SetSignVerifier(func(method, raw, key string) error { return errors.New("sign mismatch") })
+	defer SetSignVerifier(nil)
+	api.Run()
+
+	if len(sink.records) != 2 {
+		t.Fatalf("应该有 2 条审计记录 实际 %d", len(sink.records))
+	}
+	r := sink.records[0]
+	if r.Params["merchantPwd"] != AUDIT_REDACTED || r.Mac == "" || r.Params["mac"] != "" || r.OrderNo != "14337346095601" {
+		t.Errorf("审计记录错误 %+v", r)
+	}
+	if r.Sign != SIGN_UNCHECKED || sink.records[1].Sign != SIGN_INVALID {
+		t.Errorf("验签结果错误 %s %s", r.Sign, sink.records[1].Sign)
+	}
+	if strings.Contains(r.Raw, "18900000000") || !strings.Contains(r.Raw, `"payerAccount":"`+AUDIT_REDACTED+`"`) || !strings.Contains(r.Raw, `"sign":"ABCDEF"`) {
+		t.Errorf("网关返回的数据没有脱敏 %s", r.Raw)
+	}
+	if r.Sent {
+		t.Error("拦截器直接返回的 没有发送到网关")
+	}
+
+	//发送到网关的
+	ResetInterceptors()
+	sink.records = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	api.WithContext(ctx).Run()
+	if len(sink.records) != 1 || !sink.records[0].Sent || sink.records[0].Error == "" {
+		t.Errorf("审计记录错误 %+v", sink.records)
+	}
+
+	//被限流的没有发送
+	tb := NewTokenBucket(0, 1, 0)
+	tb.Take(context.Background())
+	SetRateLimiter(tb)
+	defer SetRateLimiter(nil)
+	sink.records = nil
+	api.WithContext(nil).Run()
+	if len(sink.records) != 1 || sink.records[0].Sent {
+		t.Errorf("被限流的 没有发送到网关 %+v", sink.records)
+	}
+}
+
+//测试 审计文件轮转
+func Test_file_audit_sink(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	now := time.Date(2017, 9, 1, 10, 0, 0, 0, time.Local)
+	auditNow = func() time.Time { return now }
+	defer func() { auditNow = time.Now }()
+
+	path := filepath.Join(dir, "audit.log")
+	sink, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer sink.Close()
+	sink.MaxSize = 300
+	sink.MaxBackups = 2
+
+	r := AuditRecord{ApiName: "交易查询", Params: map[string]string{"orderNo": "14337346095601"}, Sign: SIGN_ABSENT}
+	for i := 0; i < 4; i++ {
+		now = now.Add(time.Second)
+		if err := sink.Audit(r); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	//跨天
+	now = now.Add(24 * time.Hour)
+	if err := sink.Audit(r); err != nil {
+		t.Fatal(err)
+	}
+
+	backups, _ := filepath.Glob(path + ".*")
+	if len(backups) != 2 {
+		t.Errorf("应该保留 2 个旧文件 实际 %v", backups)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	lines := 0
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var v AuditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &v); err != nil {
+			t.Fatal(err)
+		}
+		lines++
+	}
+	if lines != 1 {
+		t.Errorf("跨天之后当前文件应该只有 1 条 实际 %d", lines)
+	}
+}
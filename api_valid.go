@@ -0,0 +1,314 @@
+package openbestpay
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/**
+参数校验
+所有字段的校验结果统一收集到 ValidationError 中.一次性返回所有错误的字段
+
+字段的校验规则直接写在结构体的 bestpay tag 中.字段名取 json tag 的名字.如:
+	OrderNo   string `json:"orderNo,omitempty" bestpay:"required,max=30,even"`
+	OrderDate string `json:"orderDate,omitempty" bestpay:"required,date=yyyyMMddhhmmss"`
+	OrderAmt  int    `json:"orderAmt,omitempty,string" bestpay:"min=1"`
+支持的规则:
+	required    必填
+	max=N       字符串最大长度.如果是切片则为 json 之后的长度
+	even        字符串长度必须为偶数
+	date=格式   日期格式.支持 yyyyMMddhhmmss yyyyMMdd 或者 go 的时间格式
+	min=N       数值最小值
+切片中的结构体会逐个校验.字段名为 goodsDetail[0].goodsId 这种形式
+字段之间的关系(如 orderAmt = productAmt + attachAmt)仍然在各自的 valid 中处理
+*/
+
+//校验规则
+const (
+	RULE_REQUIRED = "required" //必填
+	RULE_MAX_LEN  = "max"      //最大长度
+	RULE_EVEN_LEN = "even"     //偶数长度
+	RULE_DATE     = "date"     //日期格式
+	RULE_MIN      = "min"      //最小值
+	RULE_FORMAT   = "format"   //格式错误.如 json 序列化失败
+	RULE_SUM      = "sum"      //金额合计
+	RULE_BANK_ID  = "bankId"   //bankId 的渠道类别
+)
+
+//文档中的日期格式对应 go 的时间格式
+var dateLayouts = map[string]string{
+	"yyyyMMddhhmmss": "20060102150405",
+	"yyyyMMdd":       "20060102",
+}
+
+//单个字段的错误
+type FieldError struct {
+	Field string `json:"field"` //字段名.与接口中的参数名一致.如 orderNo
+	Rule  string `json:"rule"`  //没有通过的规则.见 RULE_*
+	Msg   string `json:"msg"`   //错误说明.默认语言.其它语言用 Localize
+
+	key  string
+	args []interface{}
+}
+
+//按指定语言返回错误说明
+func (f FieldError) Localize(l string) string {
+	if f.key == "" {
+		return f.Msg
+	}
+	return Message(l, f.key, f.args...)
+}
+
+func (f FieldError) Error() string {
+	return f.Field + " " + f.Msg
+}
+
+//校验错误.包含所有没有通过校验的字段
+type ValidationError struct {
+	Fields []FieldError `json:"fields"`
+}
+
+func (v *ValidationError) Error() string {
+	msgs := make([]string, 0, len(v.Fields))
+	for _, f := range v.Fields {
+		msgs = append(msgs, f.Error())
+	}
+	return strings.Join(msgs, "; ")
+}
+
+//是否有某个字段的错误
+func (v *ValidationError) Has(field string) bool {
+	for _, f := range v.Fields {
+		if f.Field == field {
+			return true
+		}
+	}
+	return false
+}
+
+//按指定语言返回所有字段的错误
+func (v *ValidationError) Localize(l string) []FieldError {
+	fields := make([]FieldError, 0, len(v.Fields))
+	for _, f := range v.Fields {
+		f.Msg = f.Localize(l)
+		fields = append(fields, f)
+	}
+	return fields
+}
+
+func (v *ValidationError) add(field, rule, key string, args ...interface{}) {
+	v.Fields = append(v.Fields, FieldError{
+		Field: field,
+		Rule:  rule,
+		Msg:   msg(key, args...),
+		key:   key,
+		args:  args,
+	})
+}
+
+//把另外一个校验结果合并进来.prefix 不为空的时候加在字段名前面
+func (v *ValidationError) merge(prefix string, err error) {
+	if err == nil {
+		return
+	}
+
+	ve, ok := err.(*ValidationError)
+	if !ok {
+		v.Fields = append(v.Fields, FieldError{
+			Field: prefix,
+			Rule:  RULE_FORMAT,
+			Msg:   err.Error(),
+		})
+		return
+	}
+
+	for _, f := range ve.Fields {
+		if prefix != "" {
+			f.Field = prefix + "." + f.Field
+		}
+		v.Fields = append(v.Fields, f)
+	}
+}
+
+//没有错误的时候返回 nil.避免返回一个非 nil 的空接口
+func (v *ValidationError) err() error {
+	if len(v.Fields) == 0 {
+		return nil
+	}
+	return v
+}
+
+//字符串长度校验.required 为 true 时不能为空
+func (v *ValidationError) checkLen(field, value string, required bool, max int) {
+	n := len(value)
+	if n == 0 {
+		if required {
+			v.add(field, RULE_REQUIRED, MSG_CAN_NOT_NIL)
+		}
+		return
+	}
+
+	if max > 0 && n > max {
+		v.add(field, RULE_MAX_LEN, MSG_MAX_LEN, max)
+	}
+}
+
+//日期格式校验.layout 为 go 的时间格式
+func (v *ValidationError) checkDate(field, value, layout string) {
+	if value == "" {
+		v.add(field, RULE_REQUIRED, MSG_CAN_NOT_NIL)
+		return
+	}
+
+	if _, err := time.Parse(layout, value); err != nil {
+		v.add(field, RULE_DATE, MSG_FORMAT_ERROR)
+	}
+}
+
+//数值最小值校验
+func (v *ValidationError) checkMin(field string, value, min int) {
+	if value < min {
+		v.add(field, RULE_MIN, MSG_MIN, min)
+	}
+}
+
+//按 bestpay tag 校验一个结构体
+func validStruct(v interface{}) *ValidationError {
+	ve := &ValidationError{}
+	ve.checkStruct("", reflect.ValueOf(v))
+	return ve
+}
+
+func (v *ValidationError) checkStruct(prefix string, rv reflect.Value) {
+	for rv.Kind() == reflect.Ptr {
+		if rv.IsNil() {
+			return
+		}
+		rv = rv.Elem()
+	}
+
+	if rv.Kind() != reflect.Struct {
+		return
+	}
+
+	rt := rv.Type()
+	for i := 0; i < rt.NumField(); i++ {
+		sf := rt.Field(i)
+		if sf.PkgPath != "" {
+			continue
+		}
+
+		name := sf.Name
+		if tag := sf.Tag.Get("json"); tag != "" && tag != "-" {
+			if n := strings.Split(tag, ",")[0]; n != "" {
+				name = n
+			}
+		}
+		if prefix != "" {
+			name = prefix + "." + name
+		}
+
+		fv := rv.Field(i)
+		if tag := sf.Tag.Get("bestpay"); tag != "" {
+			v.checkField(name, fv, tag)
+		}
+
+		//切片中的结构体逐个校验
+		if fv.Kind() == reflect.Slice && fv.Type().Elem().Kind() == reflect.Struct {
+			for j := 0; j < fv.Len(); j++ {
+				v.checkStruct(fmt.Sprintf("%s[%d]", name, j), fv.Index(j))
+			}
+		}
+	}
+}
+
+func (v *ValidationError) checkField(field string, fv reflect.Value, tag string) {
+	required := false
+	rules := map[string]string{}
+	for _, r := range strings.Split(tag, ",") {
+		r = strings.TrimSpace(r)
+		if r == "" {
+			continue
+		}
+		if r == RULE_REQUIRED {
+			required = true
+			continue
+		}
+		name, arg := r, ""
+		if i := strings.Index(r, "="); i > 0 {
+			name, arg = r[:i], r[i+1:]
+		}
+		switch name {
+		case RULE_MAX_LEN, RULE_MIN:
+			atoi(arg)
+		case RULE_EVEN_LEN, RULE_DATE:
+		default:
+			//tag 是写死在结构体上的.写错了直接 panic 比悄悄忽略更容易发现
+			panic(fmt.Sprintf("openbestpay: unknown rule %q in bestpay tag of %s", r, field))
+		}
+		rules[name] = arg
+	}
+
+	switch fv.Kind() {
+	case reflect.String:
+		value := fv.String()
+		if value == "" {
+			if required {
+				v.add(field, RULE_REQUIRED, MSG_CAN_NOT_NIL)
+			}
+			return
+		}
+
+		if max, ok := rules[RULE_MAX_LEN]; ok {
+			v.checkLen(field, value, false, atoi(max))
+		}
+
+		if _, ok := rules[RULE_EVEN_LEN]; ok && len(value)%2 != 0 {
+			v.add(field, RULE_EVEN_LEN, MSG_EVEN_LEN)
+		}
+
+		if layout, ok := rules[RULE_DATE]; ok {
+			if l, ok := dateLayouts[layout]; ok {
+				layout = l
+			}
+			v.checkDate(field, value, layout)
+		}
+
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		value := int(fv.Int())
+		if min, ok := rules[RULE_MIN]; ok {
+			v.checkMin(field, value, atoi(min))
+		} else if required && value == 0 {
+			v.add(field, RULE_REQUIRED, MSG_CAN_NOT_NIL)
+		}
+
+	case reflect.Slice, reflect.Map:
+		if fv.Len() == 0 {
+			if required {
+				v.add(field, RULE_REQUIRED, MSG_CAN_NOT_NIL)
+			}
+			return
+		}
+
+		if max, ok := rules[RULE_MAX_LEN]; ok {
+			if b, err := json.Marshal(fv.Interface()); err != nil {
+				v.add(field, RULE_FORMAT, MSG_FORMAT_ERROR)
+			} else if n := atoi(max); len(b) > n {
+				v.add(field, RULE_MAX_LEN, MSG_MAX_LEN, n)
+			}
+		}
+	}
+}
+
+//tag 中的数字参数.写错了直接 panic
+func atoi(s string) int {
+	n, err := strconv.Atoi(s)
+	if err != nil {
+		panic(fmt.Sprintf("openbestpay: malformed number %q in bestpay tag", s))
+	}
+	return n
+}
@@ -0,0 +1,415 @@
+package main
+
+/**
+bestpay 命令行工具.用于客服手工查询 退款等
+	bestpay [-config bestpay.json] [-o table|json] [-y] <command> [flags]
+命令:
+	pay      付款码支付  -barcode 用户付款码 -amount 金额(分)
+	query    交易查询    -order-no 订单号 -order-date yyyyMMddhhmmss
+	refund   退款        -order-no 原订单号 -amount 金额(分)
+	reverse  撤单        -order-no 原订单号 -amount 金额(分)
+商户配置来自 -config 指定的 json 文件(默认 $BESTPAY_CONFIG).环境变量优先:
+	BESTPAY_MERCHANT_ID BESTPAY_SUB_MERCHANT_ID BESTPAY_KEY BESTPAY_MERCHANT_PWD BESTPAY_STORE_ID BESTPAY_LANG
+pay refund reverse 会动账.执行前需要确认.-y 跳过确认
+执行前和出错时在 stderr 输出本次的订单号 流水号.重新执行时用 -order-no -refund-no 指定同一个
+*/
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"reflect"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"github.com/liteck/openbestpay"
+)
+
+//商户配置
+type Config struct {
+	MerchantId    string `json:"merchantId"`
+	SubMerchantId string `json:"subMerchantId"`
+	Key           string `json:"key"`         //mac 秘钥
+	MerchantPwd   string `json:"merchantPwd"` //退款 撤单时使用
+	StoreId       string `json:"storeId"`     //付款码支付时使用
+	Lang          string `json:"lang"`
+}
+
+//读取配置文件.环境变量覆盖文件中的值.path 为空时只用环境变量
+func loadConfig(path string, getenv func(string) string) (Config, error) {
+	c := Config{}
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return c, err
+		}
+		if err := json.Unmarshal(data, &c); err != nil {
+			return c, fmt.Errorf("%s: %s", path, err.Error())
+		}
+	}
+
+	for env, field := range map[string]*string{
+		"BESTPAY_MERCHANT_ID":     &c.MerchantId,
+		"BESTPAY_SUB_MERCHANT_ID": &c.SubMerchantId,
+		"BESTPAY_KEY":             &c.Key,
+		"BESTPAY_MERCHANT_PWD":    &c.MerchantPwd,
+		"BESTPAY_STORE_ID":        &c.StoreId,
+		"BESTPAY_LANG":            &c.Lang,
+	} {
+		if v := getenv(env); v != "" {
+			*field = v
+		}
+	}
+
+	if c.MerchantId == "" {
+		return c, errors.New("merchantId " + openbestpay.CAN_NOT_NIL)
+	}
+	if c.Key == "" {
+		return c, errors.New("key " + openbestpay.CAN_NOT_NIL)
+	}
+	return c, nil
+}
+
+//生成订单号 流水号.yyyyMMddhhmmss + 16 位随机数.30 位 偶数位
+func newNo(now time.Time) string {
+	return now.Format("20060102150405") + fmt.Sprintf("%016d", rand.Int63n(1e16))
+}
+
+//参数错误.flag 已经输出了错误和用法
+var errUsage = errors.New("usage")
+
+//签名之后的请求
+type request struct {
+	api     openbestpay.BestpayApi
+	result  interface{} //响应结构 Resp_bestpay_*
+	summary string      //确认时显示的摘要
+	no      string      //本次使用的订单号 流水号.执行前和出错时输出.重新执行时使用同一个
+}
+
+//一个命令
+type command struct {
+	name  string
+	desc  string
+	money bool //是否动账.需要确认
+	//解析参数并签名
+	build func(c Config, fs *flag.FlagSet, args []string) (request, error)
+}
+
+var commands = []command{
+	{
+		name:  "pay",
+		desc:  "付款码支付",
+		money: true,
+		build: func(c Config, fs *flag.FlagSet, args []string) (request, error) {
+			barcode := fs.String("barcode", "", "用户付款码")
+			amount := fs.Int("amount", 0, "金额 单位:分")
+			orderNo := fs.String("order-no", "", "订单号.默认自动生成")
+			goods := fs.String("goods", "", "商品信息")
+			attach := fs.String("attach", "", "商户附加信息")
+			if err := fs.Parse(args); err != nil {
+				return request{}, errUsage
+			}
+			if *orderNo == "" {
+				*orderNo = newNo(time.Now())
+			}
+
+			r := request{
+				api:     openbestpay.GetApi(openbestpay.BESTPAY_URL_BARCODE_PLACEORDER),
+				result:  &openbestpay.Resp_bestpay_barcode_placeorder{},
+				summary: fmt.Sprintf("付款码支付 商户 %s 订单号 %s 金额 %d 分", c.MerchantId, *orderNo, *amount),
+				no:      "orderNo " + *orderNo,
+			}
+			return r, r.api.SetBizContent(openbestpay.Biz_bestpay_barcode_placeorder{
+				MerchantId:    c.MerchantId,
+				SubMerchantId: c.SubMerchantId,
+				Barcode:       *barcode,
+				OrderNo:       *orderNo,
+				OrderReqNo:    *orderNo,
+				Channel:       "05",
+				BusiType:      "0000001",
+				OrderDate:     time.Now().Format("20060102150405"),
+				OrderAmt:      *amount,
+				ProductAmt:    *amount,
+				GoodsName:     *goods,
+				StoreId:       c.StoreId,
+				Attach:        *attach,
+			}, c.Key)
+		},
+	},
+	{
+		name: "query",
+		desc: "交易查询",
+		build: func(c Config, fs *flag.FlagSet, args []string) (request, error) {
+			orderNo := fs.String("order-no", "", "订单号")
+			orderReqNo := fs.String("order-req-no", "", "订单请求流水号.默认与订单号相同")
+			orderDate := fs.String("order-date", "", "下单时间 yyyyMMddhhmmss")
+			if err := fs.Parse(args); err != nil {
+				return request{}, errUsage
+			}
+			if *orderReqNo == "" {
+				*orderReqNo = *orderNo
+			}
+
+			r := request{
+				api:    openbestpay.GetApi(openbestpay.BESTPAY_URL_QUERYORDER),
+				result: &openbestpay.Resp_bestpay_queryorder{},
+			}
+			return r, r.api.SetBizContent(openbestpay.Biz_bestpay_queryorder{
+				MerchantId: c.MerchantId,
+				OrderNo:    *orderNo,
+				OrderReqNo: *orderReqNo,
+				OrderDate:  *orderDate,
+			}, c.Key)
+		},
+	},
+	{
+		name:  "refund",
+		desc:  "退款",
+		money: true,
+		build: func(c Config, fs *flag.FlagSet, args []string) (request, error) {
+			p, err := parseRefund(fs, args)
+			if err != nil {
+				return request{}, err
+			}
+
+			r := request{
+				api:     openbestpay.GetApi(openbestpay.BESTPAY_URL_COMMONREFUND),
+				result:  &openbestpay.Resp_bestpay_commonrefund{},
+				summary: fmt.Sprintf("退款 商户 %s 原订单号 %s 退款流水号 %s 金额 %d 分", c.MerchantId, p.orderNo, p.refundReqNo, p.amount),
+				no:      "refundReqNo " + p.refundReqNo,
+			}
+			return r, r.api.SetBizContent(openbestpay.Biz_bestpay_commonrefund{
+				MerchantId:    c.MerchantId,
+				SubMerchantId: c.SubMerchantId,
+				MerchantPwd:   c.MerchantPwd,
+				OldOrderNo:    p.orderNo,
+				OldOrderReqNo: p.orderReqNo,
+				RefundReqNo:   p.refundReqNo,
+				RefundReqDate: time.Now().Format("20060102"),
+				TransAmt:      p.amount,
+				Channel:       "05",
+			}, c.Key)
+		},
+	},
+	{
+		name:  "reverse",
+		desc:  "撤单",
+		money: true,
+		build: func(c Config, fs *flag.FlagSet, args []string) (request, error) {
+			p, err := parseRefund(fs, args)
+			if err != nil {
+				return request{}, err
+			}
+
+			r := request{
+				api:     openbestpay.GetApi(openbestpay.BESTPAY_URL_REVERSE),
+				result:  &openbestpay.Resp_bestpay_reverse{},
+				summary: fmt.Sprintf("撤单 商户 %s 原订单号 %s 撤单流水号 %s 金额 %d 分", c.MerchantId, p.orderNo, p.refundReqNo, p.amount),
+				no:      "refundReqNo " + p.refundReqNo,
+			}
+			return r, r.api.SetBizContent(openbestpay.Biz_bestpay_reverse{
+				MerchantId:    c.MerchantId,
+				SubMerchantId: c.SubMerchantId,
+				MerchantPwd:   c.MerchantPwd,
+				OldOrderNo:    p.orderNo,
+				OldOrderReqNo: p.orderReqNo,
+				RefundReqNo:   p.refundReqNo,
+				RefundReqDate: time.Now().Format("20060102"),
+				TransAmt:      p.amount,
+				Channel:       "05",
+			}, c.Key)
+		},
+	},
+}
+
+//退款和撤单的参数
+type refundParams struct {
+	orderNo     string
+	orderReqNo  string
+	refundReqNo string
+	amount      int
+}
+
+func parseRefund(fs *flag.FlagSet, args []string) (refundParams, error) {
+	orderNo := fs.String("order-no", "", "原订单号")
+	orderReqNo := fs.String("order-req-no", "", "原订单请求流水号.默认与订单号相同")
+	refundReqNo := fs.String("refund-no", "", "退款流水号.默认自动生成.重新执行时请使用同一个")
+	amount := fs.Int("amount", 0, "金额 单位:分")
+	if err := fs.Parse(args); err != nil {
+		return refundParams{}, errUsage
+	}
+
+	p := refundParams{
+		orderNo:     *orderNo,
+		orderReqNo:  *orderReqNo,
+		refundReqNo: *refundReqNo,
+		amount:      *amount,
+	}
+	if p.orderReqNo == "" {
+		p.orderReqNo = p.orderNo
+	}
+	if p.refundReqNo == "" {
+		p.refundReqNo = newNo(time.Now())
+	}
+	return p, nil
+}
+
+//读取一行确认.只有 y 或者 yes 算确认
+func confirm(in io.Reader, out io.Writer, summary string) bool {
+	fmt.Fprintf(out, "%s\n确认执行? [y/N] ", summary)
+	line, _ := bufio.NewReader(in).ReadString('\n')
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes"
+}
+
+//按 json tag 输出非空字段
+func printTable(out io.Writer, resp openbestpay.Response, lang string) error {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintf(w, "success\t%s\n", resp.Success)
+	if resp.Success != "true" {
+		fmt.Fprintf(w, "errorCode\t%s\n", resp.ErrorCode)
+		fmt.Fprintf(w, "errorMsg\t%s\n", resp.Message(lang))
+	}
+
+	v := reflect.ValueOf(resp.Result)
+	for v.Kind() == reflect.Ptr {
+		v = v.Elem()
+	}
+	if v.Kind() == reflect.Struct {
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			name := strings.Split(t.Field(i).Tag.Get("json"), ",")[0]
+			if name == "" || name == "-" {
+				continue
+			}
+			value := fmt.Sprintf("%v", v.Field(i).Interface())
+			if value == "" || value == "0" {
+				continue
+			}
+			if name == "transStatus" {
+				value += " " + openbestpay.TransStatusDesc(lang, value)
+			}
+			fmt.Fprintf(w, "%s\t%s\n", name, value)
+		}
+	}
+	return w.Flush()
+}
+
+func usage(out io.Writer) {
+	fmt.Fprintln(out, "usage: bestpay [-config file] [-o table|json] [-y] <command> [flags]")
+	fmt.Fprintln(out, "commands:")
+	for _, c := range commands {
+		fmt.Fprintf(out, "  %-8s %s\n", c.name, c.desc)
+	}
+}
+
+//返回退出码.0 成功 1 失败 2 参数错误
+func run(args []string, getenv func(string) string, in io.Reader, out, errOut io.Writer) int {
+	fs := flag.NewFlagSet("bestpay", flag.ContinueOnError)
+	fs.SetOutput(errOut)
+	configPath := fs.String("config", getenv("BESTPAY_CONFIG"), "商户配置文件 json")
+	output := fs.String("o", "table", "输出格式 table|json")
+	yes := fs.Bool("y", false, "跳过确认")
+	fs.Usage = func() { usage(errOut) }
+	if err := fs.Parse(args); err != nil {
+		return 2
+	}
+	if fs.NArg() == 0 {
+		usage(errOut)
+		return 2
+	}
+	if *output != "table" && *output != "json" {
+		fmt.Fprintln(errOut, "-o must be table or json")
+		return 2
+	}
+
+	var cmd *command
+	for i := range commands {
+		if commands[i].name == fs.Arg(0) {
+			cmd = &commands[i]
+		}
+	}
+	if cmd == nil {
+		fmt.Fprintf(errOut, "unknown command %s\n", fs.Arg(0))
+		usage(errOut)
+		return 2
+	}
+
+	c, err := loadConfig(*configPath, getenv)
+	if err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return 2
+	}
+	lang := c.Lang
+	if lang == "" {
+		lang = openbestpay.GetLang()
+	}
+
+	cfs := flag.NewFlagSet(cmd.name, flag.ContinueOnError)
+	cfs.SetOutput(errOut)
+	req, err := cmd.build(c, cfs, fs.Args()[1:])
+	//出错时再输出一次订单号 流水号.方便用同一个重新执行或者查询
+	fail := func(code int) int {
+		if req.no != "" {
+			fmt.Fprintln(errOut, req.no)
+		}
+		return code
+	}
+	if err == errUsage {
+		//flag 已经输出过错误和用法
+		return 2
+	} else if ve, ok := err.(*openbestpay.ValidationError); ok {
+		for _, f := range ve.Localize(lang) {
+			fmt.Fprintln(errOut, f.Field, f.Msg)
+		}
+		return fail(2)
+	} else if err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return fail(2)
+	}
+
+	if cmd.money && !*yes && !confirm(in, errOut, req.summary) {
+		fmt.Fprintln(errOut, "cancelled")
+		return 1
+	}
+	//-y 时没有摘要.执行前输出
+	if req.no != "" {
+		fmt.Fprintln(errOut, req.no)
+	}
+
+	api := req.api
+	if err := api.RunRetry(openbestpay.DefaultRetryPolicy()); err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return fail(1)
+	}
+
+	resp, respErr := api.Response(req.result)
+	if *output == "json" {
+		enc := json.NewEncoder(out)
+		enc.SetIndent("", "  ")
+		if err := enc.Encode(resp); err != nil {
+			fmt.Fprintln(errOut, err.Error())
+			return fail(1)
+		}
+	} else if err := printTable(out, resp, lang); err != nil {
+		fmt.Fprintln(errOut, err.Error())
+		return fail(1)
+	}
+
+	if respErr != nil {
+		return fail(1)
+	}
+	return 0
+}
+
+func main() {
+	rand.Seed(time.Now().UnixNano())
+	os.Exit(run(os.Args[1:], os.Getenv, os.Stdin, os.Stdout, os.Stderr))
+}
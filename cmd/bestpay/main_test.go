@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/liteck/openbestpay"
+)
+
+func testEnv(env map[string]string) func(string) string {
+	return func(k string) string {
+		return env[k]
+	}
+}
+
+//测试 配置文件和环境变量
+func Test_load_config(t *testing.T) {
+	dir, err := ioutil.TempDir("", "bestpay")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	path := filepath.Join(dir, "bestpay.json")
+	ioutil.WriteFile(path, []byte(`{"merchantId":"043101180050000","key":"1","storeId":"S01"}`), 0600)
+
+	c, err := loadConfig(path, testEnv(map[string]string{"BESTPAY_STORE_ID": "S02"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.MerchantId != "043101180050000" || c.StoreId != "S02" {
+		t.Errorf("环境变量应该覆盖配置文件 %+v", c)
+	}
+
+	if _, err := loadConfig("", testEnv(nil)); err == nil {
+		t.Error("没有 merchantId 应该返回错误")
+	}
+}
+
+//测试 动账命令需要确认
+func Test_run_confirm(t *testing.T) {
+	env := testEnv(map[string]string{"BESTPAY_MERCHANT_ID": "043101180050000", "BESTPAY_KEY": "1", "BESTPAY_MERCHANT_PWD": "1"})
+
+	var out, errOut bytes.Buffer
+	code := run([]string{"refund", "-order-no", "14337346095601", "-amount", "1"}, env, strings.NewReader("n\n"), &out, &errOut)
+	if code != 1 || !strings.Contains(errOut.String(), "确认执行") || !strings.Contains(errOut.String(), "cancelled") {
+		t.Errorf("没有确认不应该执行 %d %s", code, errOut.String())
+	}
+
+	errOut.Reset()
+	if code := run([]string{"refund", "-amount", "1"}, env, strings.NewReader("y\n"), &out, &errOut); code != 2 {
+		t.Errorf("缺少订单号应该是参数错误 %d %s", code, errOut.String())
+	}
+
+	if code := run([]string{"unknown"}, env, nil, &out, &errOut); code != 2 {
+		t.Errorf("未知命令应该是参数错误 %d", code)
+	}
+}
+
+//模拟网关返回 raw.记录发送的参数
+func stubGateway(raw string, params *map[string]interface{}) {
+	openbestpay.Use(func(next openbestpay.Invoker) openbestpay.Invoker {
+		return func(inv *openbestpay.Invocation) error {
+			*params = inv.Params
+			inv.Raw = raw
+			return nil
+		}
+	})
+}
+
+//测试 订单号 流水号
+func Test_new_no(t *testing.T) {
+	now := time.Date(2017, 9, 1, 0, 0, 0, 0, time.Local)
+	seen := map[string]bool{}
+	for i := 0; i < 1000; i++ {
+		no := newNo(now)
+		if len(no) != 30 || !strings.HasPrefix(no, "20170901000000") {
+			t.Fatalf("订单号格式错误 %s", no)
+		}
+		if seen[no] {
+			t.Fatalf("同一秒内订单号重复 %s", no)
+		}
+		seen[no] = true
+	}
+}
+
+//测试 表格输出
+func Test_run_table(t *testing.T) {
+	defer openbestpay.ResetInterceptors()
+	env := testEnv(map[string]string{"BESTPAY_MERCHANT_ID": "043101180050000", "BESTPAY_KEY": "1", "BESTPAY_LANG": "zh"})
+
+	params := map[string]interface{}{}
+	stubGateway(`{"success":true,"result":{"orderNo":"14337346095601","transStatus":"B","transAmt":"100"}}`, &params)
+
+	var out, errOut bytes.Buffer
+	code := run([]string{"query", "-order-no", "14337346095601", "-order-date", "20150608113649"}, env, nil, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("查询应该成功 %d %s", code, errOut.String())
+	}
+	if params["orderNo"] != "14337346095601" {
+		t.Errorf("发送的参数错误 %+v", params)
+	}
+	for _, line := range []string{"success", "orderNo", "14337346095601", "transStatus", "B"} {
+		if !strings.Contains(out.String(), line) {
+			t.Errorf("表格输出缺少 %s\n%s", line, out.String())
+		}
+	}
+}
+
+//测试 json 输出 -y 跳过确认 输出流水号
+func Test_run_json(t *testing.T) {
+	defer openbestpay.ResetInterceptors()
+	env := testEnv(map[string]string{"BESTPAY_MERCHANT_ID": "043101180050000", "BESTPAY_KEY": "1", "BESTPAY_MERCHANT_PWD": "1"})
+
+	params := map[string]interface{}{}
+	stubGateway(`{"success":true,"result":{"oldOrderNo":"14337346095601","transAmt":"1"}}`, &params)
+
+	var out, errOut bytes.Buffer
+	code := run([]string{"-o", "json", "-y", "refund", "-order-no", "14337346095601", "-amount", "1"}, env, nil, &out, &errOut)
+	if code != 0 {
+		t.Fatalf("退款应该成功 %d %s", code, errOut.String())
+	}
+	refundReqNo, _ := params["refundReqNo"].(string)
+	if refundReqNo == "" || errOut.String() != "refundReqNo "+refundReqNo+"\n" {
+		t.Errorf("执行前应该输出退款流水号 %s %+v", errOut.String(), params)
+	}
+
+	resp := struct {
+		Success string `json:"success"`
+		Result  struct {
+			OldOrderNo string `json:"oldOrderNo"`
+		} `json:"result"`
+	}{}
+	if err := json.Unmarshal(out.Bytes(), &resp); err != nil || resp.Success != "true" || resp.Result.OldOrderNo != "14337346095601" {
+		t.Errorf("json 输出错误 %v %s", err, out.String())
+	}
+
+	//失败时再输出一次
+	openbestpay.ResetInterceptors()
+	stubGateway(`{"success":false,"errorCode":"SYSTEM_ERROR","errorMsg":"系统错误"}`, &params)
+	out.Reset()
+	errOut.Reset()
+	code = run([]string{"-y", "refund", "-order-no", "14337346095601", "-amount", "1", "-refund-no", "20170901000000"}, env, nil, &out, &errOut)
+	if code != 1 || strings.Count(errOut.String(), "refundReqNo 20170901000000") != 2 {
+		t.Errorf("失败时应该再输出一次退款流水号 %d %s", code, errOut.String())
+	}
+}
@@ -0,0 +1,8 @@
+module github.com/liteck/openbestpay
+
+go 1.19
+
+// github.com/liteck/logs 和 github.com/liteck/tools 没有发布版本号.第一次构建前执行 go mod tidy 记录实际使用的版本
+
+// 只用于 -tags sqlite 的 SQLOrderStore 测试.核心包不依赖
+require github.com/mattn/go-sqlite3 v1.14.16
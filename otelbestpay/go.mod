@@ -0,0 +1,17 @@
+module github.com/liteck/openbestpay/otelbestpay
+
+go 1.19
+
+require (
+	github.com/liteck/openbestpay v0.0.0
+	go.opentelemetry.io/otel v1.11.1
+	go.opentelemetry.io/otel/trace v1.11.1
+)
+
+require (
+	github.com/go-logr/logr v1.2.3 // indirect
+	github.com/go-logr/stdr v1.2.2 // indirect
+)
+
+// 单独的 module.核心包不依赖 opentelemetry.开发时使用上层目录的代码
+replace github.com/liteck/openbestpay => ../
@@ -0,0 +1,70 @@
+package otelbestpay
+
+import (
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/liteck/openbestpay"
+)
+
+/**
+OpenTelemetry 链路追踪
+每次 Run 一个 span.父 span 来自 BestpayApi.WithContext
+	openbestpay.Use(openbestpay.Observe(otelbestpay.New(nil)))
+	api.WithContext(ctx).Run()
+*/
+
+const instrumentationName = "github.com/liteck/openbestpay"
+
+//span 的属性
+const (
+	ATTR_API_NAME     = "bestpay.api.name"
+	ATTR_API_METHOD   = "bestpay.api.method"
+	ATTR_MERCHANT_ID  = "bestpay.merchant_id"
+	ATTR_ORDER_NO     = "bestpay.order_no"
+	ATTR_TRANS_STATUS = "bestpay.trans_status"
+	ATTR_ERROR_CODE   = "bestpay.error_code"
+)
+
+type Observer struct {
+	tracer trace.Tracer
+}
+
+//tp 为空时使用 otel.GetTracerProvider()
+func New(tp trace.TracerProvider) *Observer {
+	if tp == nil {
+		tp = otel.GetTracerProvider()
+	}
+	return &Observer{tracer: tp.Tracer(instrumentationName)}
+}
+
+func (o *Observer) Begin(inv *openbestpay.Invocation) func(openbestpay.Observation) {
+	ctx, span := o.tracer.Start(inv.Ctx, "bestpay "+inv.ApiName,
+		trace.WithSpanKind(trace.SpanKindClient),
+		trace.WithAttributes(
+			attribute.String(ATTR_API_NAME, inv.ApiName),
+			attribute.String(ATTR_API_METHOD, inv.Method),
+		),
+	)
+	inv.Ctx = ctx
+
+	return func(ob openbestpay.Observation) {
+		span.SetAttributes(
+			attribute.String(ATTR_MERCHANT_ID, ob.MerchantId),
+			attribute.String(ATTR_ORDER_NO, ob.OrderNo),
+			attribute.String(ATTR_TRANS_STATUS, ob.TransStatus),
+			attribute.String(ATTR_ERROR_CODE, ob.ErrorCode),
+		)
+
+		switch {
+		case ob.Err != nil:
+			span.RecordError(ob.Err)
+			span.SetStatus(codes.Error, ob.Err.Error())
+		case !ob.Success:
+			span.SetStatus(codes.Error, ob.ErrorCode)
+		}
+		span.End()
+	}
+}
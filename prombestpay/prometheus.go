@@ -0,0 +1,98 @@
+package prombestpay
+
+import (
+	"net/url"
+
+	"github.com/prometheus/client_golang/prometheus"
+
+	"github.com/liteck/openbestpay"
+)
+
+/**
+Prometheus 指标
+	o, err := prombestpay.New(prometheus.DefaultRegisterer)
+	openbestpay.Use(openbestpay.Observe(o))
+指标:
+	bestpay_requests_total{api,result}          请求数.result 为 success fail error
+	bestpay_request_duration_seconds{api}       耗时
+	bestpay_errors_total{api,error_code}        网关返回的错误码
+api 为接口地址的 path.如 /barcode/placeOrder
+*/
+
+//请求结果
+const (
+	RESULT_SUCCESS = "success" //网关返回 success=true
+	RESULT_FAIL    = "fail"    //网关返回业务错误
+	RESULT_ERROR   = "error"   //网络错误 熔断 限流等
+)
+
+type Observer struct {
+	requests *prometheus.CounterVec
+	duration *prometheus.HistogramVec
+	errors   *prometheus.CounterVec
+}
+
+//创建并注册指标.reg 为空时使用 prometheus.DefaultRegisterer
+func New(reg prometheus.Registerer) (*Observer, error) {
+	if reg == nil {
+		reg = prometheus.DefaultRegisterer
+	}
+
+	o := &Observer{
+		requests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bestpay",
+			Name:      "requests_total",
+			Help:      "Number of bestpay gateway requests.",
+		}, []string{"api", "result"}),
+		duration: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Namespace: "bestpay",
+			Name:      "request_duration_seconds",
+			Help:      "Latency of bestpay gateway requests.",
+			Buckets:   prometheus.DefBuckets,
+		}, []string{"api"}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Namespace: "bestpay",
+			Name:      "errors_total",
+			Help:      "Number of bestpay gateway error codes.",
+		}, []string{"api", "error_code"}),
+	}
+
+	registered := []prometheus.Collector{}
+	for _, c := range []prometheus.Collector{o.requests, o.duration, o.errors} {
+		if err := reg.Register(c); err != nil {
+			//撤销已经注册的.不留下一半的指标
+			for _, r := range registered {
+				reg.Unregister(r)
+			}
+			return nil, err
+		}
+		registered = append(registered, c)
+	}
+	return o, nil
+}
+
+//接口地址的 path.接口名称是中文.不适合做标签
+func apiLabel(method string) string {
+	if u, err := url.Parse(method); err == nil && u.Path != "" {
+		return u.Path
+	}
+	return method
+}
+
+func (o *Observer) Begin(inv *openbestpay.Invocation) func(openbestpay.Observation) {
+	return func(ob openbestpay.Observation) {
+		result := RESULT_SUCCESS
+		if ob.Err != nil {
+			result = RESULT_ERROR
+		} else if !ob.Success {
+			result = RESULT_FAIL
+		}
+
+		api := apiLabel(ob.Method)
+		o.requests.WithLabelValues(api, result).Inc()
+		o.duration.WithLabelValues(api).Observe(ob.Duration.Seconds())
+		if ob.ErrorCode != "" {
+			o.errors.WithLabelValues(api, ob.ErrorCode).Inc()
+		}
+	}
+}
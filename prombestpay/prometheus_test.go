@@ -0,0 +1,52 @@
+package prombestpay
+
+import (
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+
+	"github.com/liteck/openbestpay"
+)
+
+//测试 注册失败时不留下一半的指标
+func Test_new_register_error(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	//与 errors_total 同名.第三个注册失败
+	reg.MustRegister(prometheus.NewCounter(prometheus.CounterOpts{Namespace: "bestpay", Name: "errors_total", Help: "x"}))
+
+	if _, err := New(reg); err == nil {
+		t.Fatal("指标重名 应该返回错误")
+	}
+	mfs, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(mfs) != 1 {
+		t.Errorf("注册失败之后应该撤销已经注册的指标 %d", len(mfs))
+	}
+}
+
+//测试 标签使用接口地址的 path
+func Test_observe(t *testing.T) {
+	o, err := New(prometheus.NewRegistry())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	end := o.Begin(&openbestpay.Invocation{})
+	end(openbestpay.Observation{
+		ApiName:   "交易查询",
+		Method:    openbestpay.BESTPAY_URL_QUERYORDER,
+		ErrorCode: "ORDER_NOT_EXIST",
+		Duration:  time.Second,
+	})
+
+	if v := testutil.ToFloat64(o.requests.WithLabelValues("/query/queryOrder", RESULT_FAIL)); v != 1 {
+		t.Errorf("请求数错误 %v", v)
+	}
+	if v := testutil.ToFloat64(o.errors.WithLabelValues("/query/queryOrder", "ORDER_NOT_EXIST")); v != 1 {
+		t.Errorf("错误码统计错误 %v", v)
+	}
+}